@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// MetricSummary summarizes the values of a metric over an aggregation window.
+type MetricSummary struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// AggregateStats describes the readings an aggregated ParasiteData was computed
+// from. The ParasiteData's own values hold the means.
+type AggregateStats struct {
+	Samples        int           `json:"samples"`
+	Start          time.Time     `json:"start"`
+	End            time.Time     `json:"end"`
+	SoilMoisture   MetricSummary `json:"soil_moisture"`
+	TempCelcius    MetricSummary `json:"temperature"`
+	Humidity       MetricSummary `json:"humidity"`
+	BatteryVoltage MetricSummary `json:"battery_voltage"`
+	RSSI           MetricSummary `json:"rssi"`
+}
+
+type AggregateConfig struct {
+	Window time.Duration `yaml:"window"`
+}
+
+// Aggregator wraps a DataSubscriber, and feeds it one reading per device and
+// window instead of every reading.
+type Aggregator struct {
+	subscriber DataSubscriber
+	window     time.Duration
+	incoming   chan *ParasiteData
+	buckets    map[string][]*ParasiteData
+}
+
+func MakeAggregator(subscriber DataSubscriber, window time.Duration) *Aggregator {
+	return &Aggregator{
+		subscriber: subscriber,
+		window:     window,
+		incoming:   make(chan *ParasiteData),
+		buckets:    map[string][]*ParasiteData{},
+	}
+}
+
+func (agg *Aggregator) Ingest(data *ParasiteData) {
+	agg.incoming <- data
+}
+
+func (agg *Aggregator) Run() {
+	go agg.subscriber.Run()
+
+	interval := agg.window / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-agg.incoming:
+			agg.buckets[data.Key] = append(agg.buckets[data.Key], data)
+		case now := <-ticker.C:
+			// A device's window starts with its first reading.
+			for key, bucket := range agg.buckets {
+				if now.Sub(bucket[0].Time) >= agg.window {
+					delete(agg.buckets, key)
+					agg.subscriber.Ingest(aggregate(bucket))
+				}
+			}
+		}
+	}
+}
+
+// summarize computes the summary of a metric, as returned by getter, over the
+// readings of bucket that have a value for it. It reports false if none has.
+func summarize(bucket []*ParasiteData, key string, getter func(data *ParasiteData) float64) (MetricSummary, bool) {
+	values := []float64{}
+	for _, data := range bucket {
+		if data.HasMetric(key) {
+			values = append(values, getter(data))
+		}
+	}
+	if len(values) == 0 {
+		return MetricSummary{}, false
+	}
+	summary := MetricSummary{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, value := range values {
+		summary.Mean += value / float64(len(values))
+		summary.Min = math.Min(summary.Min, value)
+		summary.Max = math.Max(summary.Max, value)
+	}
+	return summary, true
+}
+
+func aggregate(bucket []*ParasiteData) *ParasiteData {
+	last := bucket[len(bucket)-1]
+	missing := []string{}
+	summarizeMetric := func(key string, getter func(data *ParasiteData) float64) MetricSummary {
+		summary, ok := summarize(bucket, key, getter)
+		if !ok {
+			missing = append(missing, key)
+		}
+		return summary
+	}
+	stats := &AggregateStats{
+		Samples:        len(bucket),
+		Start:          bucket[0].Time,
+		End:            last.Time,
+		SoilMoisture:   summarizeMetric("soil_moisture", func(data *ParasiteData) float64 { return float64(data.SoilMoisture) }),
+		TempCelcius:    summarizeMetric("temperature", func(data *ParasiteData) float64 { return float64(data.TempCelcius) }),
+		Humidity:       summarizeMetric("humidity", func(data *ParasiteData) float64 { return float64(data.Humidity) }),
+		BatteryVoltage: summarizeMetric("battery_voltage", func(data *ParasiteData) float64 { return float64(data.BatteryVoltage) }),
+		RSSI:           summarizeMetric("rssi", func(data *ParasiteData) float64 { return float64(data.RSSI) }),
+	}
+	if len(missing) == 0 {
+		missing = nil
+	}
+	return &ParasiteData{
+		Key:            last.Key,
+		Counter:        last.Counter,
+		SoilMoisture:   float32(stats.SoilMoisture.Mean),
+		TempCelcius:    float32(stats.TempCelcius.Mean),
+		Humidity:       float32(stats.Humidity.Mean),
+		BatteryVoltage: float32(stats.BatteryVoltage.Mean),
+		RSSI:           int(math.Round(stats.RSSI.Mean)),
+		Time:           last.Time,
+		Aggregate:      stats,
+		Missing:        missing,
+	}
+}
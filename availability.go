@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DeviceTracker keeps track of when each device was last heard from, and
+// considers devices that have been silent for longer than timeout offline.
+// It also keeps the latest reading of each device.
+type DeviceTracker struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	lastSeen map[MACAddr]time.Time
+	online   map[MACAddr]bool
+	latest   map[MACAddr]*ParasiteData
+}
+
+func MakeDeviceTracker(timeout time.Duration) *DeviceTracker {
+	return &DeviceTracker{
+		timeout:  timeout,
+		lastSeen: map[MACAddr]time.Time{},
+		online:   map[MACAddr]bool{},
+		latest:   map[MACAddr]*ParasiteData{},
+	}
+}
+
+// Seen records a reading and reports whether the device just came (back)
+// online.
+func (tracker *DeviceTracker) Seen(macAddr MACAddr, data *ParasiteData) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if data.Time.After(tracker.lastSeen[macAddr]) {
+		tracker.lastSeen[macAddr] = data.Time
+		tracker.latest[macAddr] = data
+	}
+	if tracker.online[macAddr] || time.Since(tracker.lastSeen[macAddr]) > tracker.timeout {
+		return false
+	}
+	tracker.online[macAddr] = true
+	return true
+}
+
+// Expire marks devices that have been silent for longer than the timeout as
+// offline, and returns the ones that just went offline.
+func (tracker *DeviceTracker) Expire() []MACAddr {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	expired := []MACAddr{}
+	for macAddr, online := range tracker.online {
+		if online && time.Since(tracker.lastSeen[macAddr]) > tracker.timeout {
+			tracker.online[macAddr] = false
+			expired = append(expired, macAddr)
+		}
+	}
+	return expired
+}
+
+// ExpireEvery periodically expires silent devices, and calls expired for each
+// one that just went offline. On standby, devices are expired all the same, but
+// expired isn't called, since publishing is left to the leader.
+func (tracker *DeviceTracker) ExpireEvery(expired func(macAddr MACAddr)) {
+	interval := tracker.timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		for _, macAddr := range tracker.Expire() {
+			if isLeader() {
+				expired(macAddr)
+			}
+		}
+	}
+}
+
+func (tracker *DeviceTracker) IsOnline(macAddr MACAddr) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.online[macAddr]
+}
+
+// Latest returns the most recent reading of the device, or nil if it hasn't
+// been heard from.
+func (tracker *DeviceTracker) Latest(macAddr MACAddr) *ParasiteData {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.latest[macAddr]
+}
+
+func availabilityPayload(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+// publishDeviceAvailability publishes the availability of a single device.
+func (client *MQTTClient) publishDeviceAvailability(macAddr MACAddr, online bool) {
+	deviceConfig, exists := client.registry()[macAddr]
+	if !exists || client.config.DeviceAvailabilityTimeout == 0 {
+		return
+	}
+	client.Publish(client.config.DeviceAvailabilityTopic(deviceConfig), availabilityPayload(online), true, 1)
+}
+
+// publishAllDeviceAvailability publishes the availability of every device in
+// the registry. Devices we haven't heard from yet are reported offline.
+func (client *MQTTClient) publishAllDeviceAvailability() {
+	for macAddr := range client.registry() {
+		client.publishDeviceAvailability(macAddr, client.devices.IsOnline(macAddr))
+	}
+}
+
+// expireDevices periodically marks silent devices as offline.
+func (client *MQTTClient) expireDevices() {
+	client.devices.ExpireEvery(func(macAddr MACAddr) {
+		logger.Printf("[mqtt] Haven't heard from %s in %s, marking it offline\n", macAddr, client.config.DeviceAvailabilityTimeout)
+		client.publishDeviceAvailability(macAddr, false)
+	})
+}
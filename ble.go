@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"strings"
 	"time"
@@ -11,20 +12,31 @@ import (
 
 const kMacOSMACAddrPrefix = "f0:ca:f0:ca:"
 
+// ParasiteScanner is the source of readings received by the local BLE adapter.
+// If the gateway is configured, it's also handed every advertisement.
 type ParasiteScanner struct {
-	// We use a wrap-around counter inside the advertisement payload for
-	// deduplicating messages.
-	lastCounter map[string]int
-	channel     chan *ParasiteData
-	cfg         *BLEConfig
+	cfg     *BLEConfig
+	gateway *BLEGateway
 }
 
-func MakeParasiteScanner(cfg *BLEConfig) *ParasiteScanner {
-	return &ParasiteScanner{
-		lastCounter: map[string]int{},
-		channel:     make(chan *ParasiteData),
-		cfg:         cfg,
+func init() {
+	RegisterSource("ble", func(cfg *SourceConfig) (DataSource, error) {
+		return MakeParasiteScanner(&cfg.root.BLE)
+	})
+}
+
+func MakeParasiteScanner(cfg *BLEConfig) (*ParasiteScanner, error) {
+	scanner := &ParasiteScanner{
+		cfg: cfg,
+	}
+	if cfg.Gateway != nil {
+		gateway, err := MakeBLEGateway(cfg.Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("gateway: %s", err.Error())
+		}
+		scanner.gateway = gateway
 	}
+	return scanner, nil
 }
 
 // This is a workaround for getting the MAC address on macOS.
@@ -35,8 +47,8 @@ func MakeParasiteScanner(cfg *BLEConfig) *ParasiteScanner {
 // reasons, and the API only returns an UUID for us instead.
 // To get around this, p-parasite encodes its own MAC addresses
 // in its advertisement data, which we try to pull here.
-func getKey(cfg *BLEConfig, scanResult *bluetooth.ScanResult) string {
-	addr := strings.ToLower(scanResult.Address.String())
+func getKey(cfg *BLEConfig, address string, serviceData []byte) string {
+	addr := strings.ToLower(address)
 	if !cfg.MacOS.InferMACAddress {
 		return addr
 	}
@@ -48,7 +60,6 @@ func getKey(cfg *BLEConfig, scanResult *bluetooth.ScanResult) string {
 		return addr
 	} else {
 		// macOS - we try to read the MAC address from the payload data.
-		serviceData := scanResult.AdvertisementPayload.GetServiceDatas()[0].Data
 		if len(serviceData) < 16 {
 			logger.Printf("[ble] Unable to infer MAC address from %s\n", addr)
 			return addr
@@ -58,61 +69,95 @@ func getKey(cfg *BLEConfig, scanResult *bluetooth.ScanResult) string {
 	}
 }
 
-func parseParasiteData(cfg *BLEConfig, scanResult bluetooth.ScanResult) (*ParasiteData, error) {
-	if len(scanResult.AdvertisementPayload.GetServiceDatas()) != 1 {
-		return nil, fmt.Errorf("unexpected length of service datas")
-	}
+// The b-parasite service data holds the counter, battery voltage, temperature,
+// humidity and soil moisture in its first 10 bytes.
+const kMinServiceDataLength = 10
 
-	serviceData := scanResult.AdvertisementPayload.GetServiceDatas()[0]
-
-	uuid := serviceData.UUID
-	if !uuid.Is16Bit() || uuid.Get16Bit() != 0x181a {
-		return nil, fmt.Errorf("invalid service data uuid: %s", uuid)
+// decodeParasiteData decodes the service data of a b-parasite advertisement
+// received from address. It's shared by everything that receives
+// advertisements, wherever they were picked up.
+func decodeParasiteData(cfg *BLEConfig, address string, serviceData []byte, rssi int) (*ParasiteData, error) {
+	if len(serviceData) < kMinServiceDataLength {
+		return nil, fmt.Errorf("service data too short: %d bytes", len(serviceData))
 	}
 
-	counter := serviceData.Data[1] & 0x0f
-	batteryVoltage := binary.BigEndian.Uint16(serviceData.Data[2:4])
-	tempCelcius := binary.BigEndian.Uint16(serviceData.Data[4:6])
-	humidity := binary.BigEndian.Uint16(serviceData.Data[6:8])
-	soilMoisture := binary.BigEndian.Uint16(serviceData.Data[8:10])
+	counter := serviceData[1] & 0x0f
+	batteryVoltage := binary.BigEndian.Uint16(serviceData[2:4])
+	tempCelcius := binary.BigEndian.Uint16(serviceData[4:6])
+	humidity := binary.BigEndian.Uint16(serviceData[6:8])
+	soilMoisture := binary.BigEndian.Uint16(serviceData[8:10])
 
 	return &ParasiteData{
-		Key:            getKey(cfg, &scanResult),
+		Key:            getKey(cfg, address, serviceData),
 		Counter:        counter,
 		BatteryVoltage: float32(batteryVoltage) / 1000,
 		TempCelcius:    float32(tempCelcius) / 1000,
 		Humidity:       100 * float32(humidity) / (1 << 16),
 		SoilMoisture:   100 * float32(soilMoisture) / (1 << 16),
 		Time:           time.Now(),
-		RSSI:           int(scanResult.RSSI),
+		RSSI:           rssi,
 	}, nil
 }
 
-func (scanner *ParasiteScanner) Run() {
+func parseParasiteData(cfg *BLEConfig, scanResult bluetooth.ScanResult) (*ParasiteData, error) {
+	if len(scanResult.AdvertisementPayload.GetServiceDatas()) != 1 {
+		return nil, fmt.Errorf("unexpected length of service datas")
+	}
+
+	serviceData := scanResult.AdvertisementPayload.GetServiceDatas()[0]
+
+	uuid := serviceData.UUID
+	if !uuid.Is16Bit() || uuid.Get16Bit() != 0x181a {
+		return nil, fmt.Errorf("invalid service data uuid: %s", uuid)
+	}
+
+	data, err := decodeParasiteData(cfg, scanResult.Address.String(), serviceData.Data, int(scanResult.RSSI))
+	if err != nil {
+		return nil, err
+	}
+	data.Advertisement = &RawAdvertisement{
+		Address:     scanResult.Address.String(),
+		RSSI:        data.RSSI,
+		ServiceData: hex.EncodeToString(serviceData.Data),
+		Time:        data.Time,
+	}
+	return data, nil
+}
+
+func (scanner *ParasiteScanner) Run(sink chan<- *ParasiteData) {
 	var adapter = bluetooth.DefaultAdapter
 
+	stats.SetAdapterState("enabling")
 	if err := adapter.Enable(); err != nil {
+		stats.SetAdapterState("error")
 		panic("unable to initialize the BLE stack: " + err.Error())
 	}
 
+	if scanner.gateway != nil {
+		go scanner.gateway.Run()
+	}
+
+	stats.SetAdapterState("scanning")
 	err := adapter.Scan(func(adapter *bluetooth.Adapter, scanResult bluetooth.ScanResult) {
-		if scanResult.LocalName() == "prst" {
+		isParasite := scanResult.LocalName() == kParasiteLocalName
+		stats.RecordAdvertisement(isParasite)
+		if scanner.gateway != nil {
+			scanner.gateway.Handle(&scanResult)
+		}
+		if isParasite && *scanner.cfg.Decode {
 			data, err := parseParasiteData(scanner.cfg, scanResult)
 			if err != nil {
+				stats.RecordDecodeError()
 				logger.Println("error parsing parasite data:", err.Error())
 			} else {
-				// Have we processed this data already?
-				if oldCounter, exists := scanner.lastCounter[data.Key]; exists && oldCounter == int(data.Counter) {
-					logger.Println("[ble] Skipping already processed data (based on counter):", data)
-					return
-				}
-				scanner.lastCounter[data.Key] = int(data.Counter)
-				scanner.channel <- data
+				sink <- data
 			}
 		}
 	})
 
 	if err != nil {
+		stats.SetAdapterState("error")
 		panic("unable to start scanning: " + err.Error())
 	}
+	stats.SetAdapterState("stopped")
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tinygo.org/x/bluetooth"
+)
+
+// BLEGatewayConfig configures the publishing of the raw advertisements the
+// local adapter hears, so other systems can decode devices we don't know about.
+type BLEGatewayConfig struct {
+	MQTT *MQTTLinkConfig `yaml:"mqtt"`
+	// Advertisements matching any of the filters are published. Without
+	// filters, every advertisement is.
+	Filters []*AdvertisementFilter `yaml:"filters"`
+}
+
+// AdvertisementFilter matches advertisements that satisfy all of its
+// conditions.
+type AdvertisementFilter struct {
+	// A case-insensitive prefix of the address.
+	MAC         string `yaml:"mac"`
+	Name        string `yaml:"name"`
+	ServiceUUID string `yaml:"service_uuid"`
+	MinRSSI     int    `yaml:"min_rssi"`
+	serviceUUID *bluetooth.UUID
+}
+
+// Advertisements are published to <topic>/<mac without colons>.
+const kDefaultBLEGatewayTopic = "parasite-scanner/ble"
+
+// The number of advertisements waiting to be published. The scan callback must
+// not block, so advertisements are dropped when the broker can't keep up.
+const kBLEGatewayQueueSize = 256
+
+func ValidateBLEGatewayConfig(cfg *BLEGatewayConfig) error {
+	if cfg.MQTT == nil {
+		return fmt.Errorf("missing mqtt")
+	}
+	if err := ValidateMQTTLinkConfig(cfg.MQTT, kDefaultBLEGatewayTopic); err != nil {
+		return fmt.Errorf("mqtt: %s", err.Error())
+	}
+	for i, filter := range cfg.Filters {
+		filter.MAC = strings.ToLower(filter.MAC)
+		if filter.ServiceUUID != "" {
+			uuid, err := bluetooth.ParseUUID(strings.TrimPrefix(strings.ToLower(filter.ServiceUUID), "0x"))
+			if err != nil {
+				return fmt.Errorf("filters: #%d: invalid service_uuid %q", i, filter.ServiceUUID)
+			}
+			filter.serviceUUID = &uuid
+		}
+	}
+	return nil
+}
+
+// BLEAdvertisement is the JSON document published for each advertisement.
+// Its format is accepted by the `gateway` source, so instances can act as
+// gateways for each other.
+type BLEAdvertisement struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name,omitempty"`
+	RSSI int    `json:"rssi"`
+	// Maps UUIDs (in their 16-bit form where possible) to hex-encoded data.
+	ServiceData map[string]string `json:"service_data,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+func formatUUID(uuid bluetooth.UUID) string {
+	if uuid.Is16Bit() {
+		return fmt.Sprintf("%04x", uuid.Get16Bit())
+	}
+	return uuid.String()
+}
+
+func (filter *AdvertisementFilter) Matches(scanResult *bluetooth.ScanResult) bool {
+	if filter.MAC != "" && !strings.HasPrefix(strings.ToLower(scanResult.Address.String()), filter.MAC) {
+		return false
+	}
+	if filter.Name != "" && scanResult.LocalName() != filter.Name {
+		return false
+	}
+	if filter.MinRSSI != 0 && int(scanResult.RSSI) < filter.MinRSSI {
+		return false
+	}
+	if filter.serviceUUID != nil && !scanResult.HasServiceUUID(*filter.serviceUUID) {
+		found := false
+		for _, serviceData := range scanResult.AdvertisementPayload.GetServiceDatas() {
+			found = found || serviceData.UUID == *filter.serviceUUID
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// BLEGateway publishes the advertisements heard by the local adapter to MQTT.
+type BLEGateway struct {
+	config   *BLEGatewayConfig
+	client   mqtt.Client
+	outgoing chan *BLEAdvertisement
+}
+
+func MakeBLEGateway(cfg *BLEGatewayConfig) (*BLEGateway, error) {
+	opts, err := makeLinkClientOptions(cfg.MQTT)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetOnConnectHandler(func(_ mqtt.Client) {
+		logger.Printf("[gateway] Connected to %s\n", cfg.MQTT.Host)
+	})
+	return &BLEGateway{
+		config:   cfg,
+		client:   mqtt.NewClient(opts),
+		outgoing: make(chan *BLEAdvertisement, kBLEGatewayQueueSize),
+	}, nil
+}
+
+// Handle queues an advertisement for publishing if it passes the filters. It's
+// called from the scan callback, so it copies what it needs from scanResult
+// and never blocks.
+func (gateway *BLEGateway) Handle(scanResult *bluetooth.ScanResult) {
+	if len(gateway.config.Filters) > 0 {
+		matches := false
+		for _, filter := range gateway.config.Filters {
+			if filter.Matches(scanResult) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return
+		}
+	}
+
+	adv := &BLEAdvertisement{
+		MAC:         strings.ToLower(scanResult.Address.String()),
+		Name:        scanResult.LocalName(),
+		RSSI:        int(scanResult.RSSI),
+		ServiceData: map[string]string{},
+		Time:        time.Now(),
+	}
+	for _, serviceData := range scanResult.AdvertisementPayload.GetServiceDatas() {
+		adv.ServiceData[formatUUID(serviceData.UUID)] = hex.EncodeToString(serviceData.Data)
+	}
+
+	select {
+	case gateway.outgoing <- adv:
+	default:
+		logger.Printf("[gateway] Can't keep up, dropping advertisement from %s\n", adv.MAC)
+	}
+}
+
+func (gateway *BLEGateway) Run() {
+	go connectWithRetry(gateway.client, gateway.config.MQTT.Host)
+
+	for adv := range gateway.outgoing {
+		if !gateway.client.IsConnectionOpen() {
+			continue
+		}
+		payload, err := json.Marshal(adv)
+		if err != nil {
+			logger.Printf("[gateway] Unable to encode advertisement from %s: %s\n", adv.MAC, err.Error())
+			continue
+		}
+		// Advertisements come in far too fast, and to too many topics, for
+		// tracking each publish like readings are. A lost one is soon followed
+		// by the next.
+		topic := gateway.config.MQTT.Topic + "/" + strings.Replace(adv.MAC, ":", "", -1)
+		gateway.client.Publish(topic, 0, false, payload)
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// BrokerConfig configures the embedded MQTT broker.
+type BrokerConfig struct {
+	Listen string `yaml:"listen"`
+	// Maps usernames to passwords. If empty, anyone may connect, which is only
+	// allowed when listening on loopback.
+	Users map[string]string `yaml:"users"`
+}
+
+// Only in-process clients can reach the broker by default. Anyone who can
+// reach it can also send commands to the scanner.
+const kDefaultBrokerListen = "127.0.0.1:1883"
+
+// The `host` MQTT outputs use to connect to the embedded broker.
+const kEmbeddedBrokerHost = "embedded"
+
+// How long a client has to send CONNECT after opening the connection, and to
+// read what we write to it.
+const kBrokerConnectTimeout = 10 * time.Second
+const kBrokerWriteTimeout = 10 * time.Second
+
+// The number of messages waiting to be written to a client. Messages for
+// clients that can't keep up are dropped.
+const kBrokerSessionQueueSize = 256
+
+// Packets are read into memory whole, so their size is capped: tightly before
+// the client is authenticated, and loosely after.
+const kBrokerMaxConnectSize = 4 * 1024
+const kBrokerMaxPacketSize = 256 * 1024
+
+func ValidateBrokerConfig(cfg *BrokerConfig) error {
+	if cfg.Listen == "" {
+		cfg.Listen = kDefaultBrokerListen
+	}
+	for username := range cfg.Users {
+		if username == "" {
+			return fmt.Errorf("users: empty username")
+		}
+	}
+	if len(cfg.Users) == 0 && !isLoopbackAddr(cfg.Listen) {
+		return fmt.Errorf("users must be set to listen on %s, which isn't a loopback address", cfg.Listen)
+	}
+	return nil
+}
+
+// isLoopbackAddr reports whether a listen address only accepts connections from
+// the local machine. Empty hosts listen on every interface.
+func isLoopbackAddr(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// The URL of the embedded broker, set once it's listening.
+var embeddedBrokerURL string
+
+// Broker is a minimal MQTT 3.1.1 broker, so small installs don't need to run
+// one of their own. It supports QoS 0 and 1 (QoS 2 publishes are accepted, but
+// delivered with QoS 1 at most), retained messages, wills and
+// username/password authentication. Sessions are always clean: subscriptions
+// don't outlive the connection, and messages published while a client is
+// disconnected aren't queued for it.
+type Broker struct {
+	config   *BrokerConfig
+	listener net.Listener
+	mu       sync.Mutex
+	sessions map[string]*brokerSession
+	retained map[string]*packets.PublishPacket
+}
+
+type brokerSession struct {
+	conn     net.Conn
+	clientID string
+	will     *packets.PublishPacket
+	outgoing chan packets.ControlPacket
+	closed   chan struct{}
+	// Guards subscriptions and nextID, which are also accessed by publishers.
+	mu            sync.Mutex
+	subscriptions map[string]byte
+	nextID        uint16
+}
+
+func MakeBroker(cfg *BrokerConfig) (*Broker, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	// In-process clients connect over loopback, whatever interface we listen on.
+	addr := listener.Addr().(*net.TCPAddr)
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	embeddedBrokerURL = "tcp://" + net.JoinHostPort(host, fmt.Sprint(addr.Port))
+	return &Broker{
+		config:   cfg,
+		listener: listener,
+		sessions: map[string]*brokerSession{},
+		retained: map[string]*packets.PublishPacket{},
+	}, nil
+}
+
+func (broker *Broker) Run() {
+	logger.Printf("[broker] Listening on %s\n", broker.listener.Addr())
+	for {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			logger.Printf("[broker] Unable to accept connection: %s\n", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go broker.serve(conn)
+	}
+}
+
+func (broker *Broker) authenticate(connect *packets.ConnectPacket) byte {
+	if len(broker.config.Users) == 0 {
+		return packets.Accepted
+	}
+	if !connect.UsernameFlag {
+		return packets.ErrRefusedNotAuthorised
+	}
+	password, exists := broker.config.Users[connect.Username]
+	if !exists || subtle.ConstantTimeCompare([]byte(password), connect.Password) != 1 {
+		return packets.ErrRefusedBadUsernameOrPassword
+	}
+	return packets.Accepted
+}
+
+func (broker *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(kBrokerConnectTimeout))
+	packet, err := readPacket(conn, kBrokerMaxConnectSize)
+	if err != nil {
+		logger.Printf("[broker] Unable to read CONNECT from %s: %s\n", conn.RemoteAddr(), err.Error())
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		logger.Printf("[broker] Expected CONNECT from %s, got %s\n", conn.RemoteAddr(), packet.String())
+		return
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = connect.Validate()
+	if connack.ReturnCode == packets.Accepted {
+		connack.ReturnCode = broker.authenticate(connect)
+	}
+	if connack.ReturnCode != packets.Accepted {
+		logger.Printf("[broker] Refusing connection from %s (%q): %s\n", conn.RemoteAddr(), connect.ClientIdentifier, packets.ConnackReturnCodes[connack.ReturnCode])
+		if connack.ReturnCode != packets.ErrProtocolViolation {
+			conn.SetWriteDeadline(time.Now().Add(kBrokerWriteTimeout))
+			connack.Write(conn)
+		}
+		return
+	}
+
+	session := &brokerSession{
+		conn:          conn,
+		clientID:      connect.ClientIdentifier,
+		outgoing:      make(chan packets.ControlPacket, kBrokerSessionQueueSize),
+		closed:        make(chan struct{}),
+		subscriptions: map[string]byte{},
+	}
+	if session.clientID == "" {
+		session.clientID = fmt.Sprintf("auto-%016x", rand.Uint64())
+	}
+	if connect.WillFlag {
+		session.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		session.will.TopicName = connect.WillTopic
+		session.will.Payload = connect.WillMessage
+		session.will.Qos = connect.WillQos
+		session.will.Retain = connect.WillRetain
+	}
+	// CONNACK must be the first packet the client gets, so it's queued before
+	// the session becomes visible to publishers.
+	session.reply(connack)
+	go session.write()
+	broker.register(session)
+	defer broker.unregister(session)
+	logger.Printf("[broker] %s connected from %s\n", session.clientID, conn.RemoteAddr())
+
+	// Clients that stay silent for one and a half keep alive periods are
+	// considered gone.
+	keepAlive := time.Duration(connect.Keepalive) * time.Second * 3 / 2
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := readPacket(conn, kBrokerMaxPacketSize)
+		if err != nil {
+			logger.Printf("[broker] Lost connection to %s: %s\n", session.clientID, err.Error())
+			return
+		}
+		if _, ok := packet.(*packets.DisconnectPacket); ok {
+			logger.Printf("[broker] %s disconnected\n", session.clientID)
+			session.will = nil
+			return
+		}
+		if err := broker.handle(session, packet); err != nil {
+			logger.Printf("[broker] Disconnecting %s: %s\n", session.clientID, err.Error())
+			return
+		}
+	}
+}
+
+// readPacket is packets.ReadPacket, except that it refuses packets whose
+// remaining length exceeds maxSize before reading them.
+func readPacket(r io.Reader, maxSize int) (packets.ControlPacket, error) {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	// The remaining length is encoded in up to four bytes, seven bits each.
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("malformed remaining length")
+		}
+		digit := make([]byte, 1)
+		if _, err := io.ReadFull(r, digit); err != nil {
+			return nil, err
+		}
+		length |= int(digit[0]&0x7f) << (7 * i)
+		if digit[0]&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxSize {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the limit of %d bytes", length, maxSize)
+	}
+	packet, err := packets.NewControlPacketWithHeader(packets.FixedHeader{
+		MessageType:     header[0] >> 4,
+		Dup:             header[0]&0x08 != 0,
+		Qos:             (header[0] >> 1) & 0x03,
+		Retain:          header[0]&0x01 != 0,
+		RemainingLength: length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return packet, packet.Unpack(bytes.NewBuffer(body))
+}
+
+// register makes the session visible to publishers. A client connecting with
+// the ID of a connected client takes over, so the latter is disconnected.
+func (broker *Broker) register(session *brokerSession) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if existing, exists := broker.sessions[session.clientID]; exists {
+		logger.Printf("[broker] %s reconnected, closing its previous connection\n", session.clientID)
+		existing.conn.Close()
+	}
+	broker.sessions[session.clientID] = session
+}
+
+// unregister tears down a session, publishing its will unless the client
+// disconnected cleanly.
+func (broker *Broker) unregister(session *brokerSession) {
+	broker.mu.Lock()
+	if broker.sessions[session.clientID] == session {
+		delete(broker.sessions, session.clientID)
+	}
+	broker.mu.Unlock()
+	close(session.closed)
+	session.conn.Close()
+	if session.will != nil {
+		broker.publish(session.will)
+	}
+}
+
+func (broker *Broker) handle(session *brokerSession, packet packets.ControlPacket) error {
+	switch p := packet.(type) {
+	case *packets.PublishPacket:
+		if !isValidTopic(p.TopicName) {
+			return fmt.Errorf("invalid topic %q", p.TopicName)
+		}
+		switch p.Qos {
+		case 1:
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = p.MessageID
+			session.reply(puback)
+		case 2:
+			pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			pubrec.MessageID = p.MessageID
+			session.reply(pubrec)
+		}
+		broker.publish(p)
+	case *packets.PubrelPacket:
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = p.MessageID
+		session.reply(pubcomp)
+	case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubcompPacket:
+		// We don't redeliver messages, so there's nothing to keep track of.
+	case *packets.SubscribePacket:
+		suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		suback.MessageID = p.MessageID
+		for i, filter := range p.Topics {
+			if !isValidTopicFilter(filter) {
+				suback.ReturnCodes = append(suback.ReturnCodes, 0x80)
+				continue
+			}
+			qos := p.Qoss[i]
+			if qos > 1 {
+				qos = 1
+			}
+			session.mu.Lock()
+			session.subscriptions[filter] = qos
+			session.mu.Unlock()
+			suback.ReturnCodes = append(suback.ReturnCodes, qos)
+		}
+		session.reply(suback)
+		broker.deliverRetained(session, p.Topics)
+	case *packets.UnsubscribePacket:
+		session.mu.Lock()
+		for _, filter := range p.Topics {
+			delete(session.subscriptions, filter)
+		}
+		session.mu.Unlock()
+		unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		unsuback.MessageID = p.MessageID
+		session.reply(unsuback)
+	case *packets.PingreqPacket:
+		session.reply(packets.NewControlPacket(packets.Pingresp))
+	default:
+		return fmt.Errorf("unexpected %s", packet.String())
+	}
+	return nil
+}
+
+// publish updates the retained messages and delivers the message to every
+// matching subscription.
+func (broker *Broker) publish(p *packets.PublishPacket) {
+	broker.mu.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(broker.retained, p.TopicName)
+		} else {
+			broker.retained[p.TopicName] = p
+		}
+	}
+	sessions := make([]*brokerSession, 0, len(broker.sessions))
+	for _, session := range broker.sessions {
+		sessions = append(sessions, session)
+	}
+	broker.mu.Unlock()
+
+	for _, session := range sessions {
+		if qos, matches := session.match(p.TopicName); matches {
+			session.deliver(p, qos, false)
+		}
+	}
+}
+
+// deliverRetained sends the retained messages matching any of the filters a
+// client just subscribed to.
+func (broker *Broker) deliverRetained(session *brokerSession, filters []string) {
+	broker.mu.Lock()
+	retained := []*packets.PublishPacket{}
+	for topic, p := range broker.retained {
+		for _, filter := range filters {
+			if topicMatches(filter, topic) {
+				retained = append(retained, p)
+				break
+			}
+		}
+	}
+	broker.mu.Unlock()
+
+	for _, p := range retained {
+		if qos, matches := session.match(p.TopicName); matches {
+			session.deliver(p, qos, true)
+		}
+	}
+}
+
+// match reports whether any of the session's subscriptions matches the topic,
+// along with the highest QoS among the matching ones.
+func (session *brokerSession) match(topic string) (byte, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	var qos byte
+	matches := false
+	for filter, filterQos := range session.subscriptions {
+		if topicMatches(filter, topic) {
+			matches = true
+			if filterQos > qos {
+				qos = filterQos
+			}
+		}
+	}
+	return qos, matches
+}
+
+// deliver queues a message for the client, with the lower of the published and
+// the subscribed QoS.
+func (session *brokerSession) deliver(p *packets.PublishPacket, qos byte, retain bool) {
+	out := p.Copy()
+	out.Qos = p.Qos
+	if qos < out.Qos {
+		out.Qos = qos
+	}
+	out.Retain = retain
+	if out.Qos > 0 {
+		session.mu.Lock()
+		session.nextID++
+		if session.nextID == 0 {
+			session.nextID = 1
+		}
+		out.MessageID = session.nextID
+		session.mu.Unlock()
+	}
+	select {
+	case session.outgoing <- out:
+	case <-session.closed:
+	default:
+		logger.Printf("[broker] %s isn't keeping up, dropping message to %s\n", session.clientID, p.TopicName)
+	}
+}
+
+// reply queues a response to one of the client's packets. Unlike deliver, it
+// waits for room in the queue rather than dropping the packet.
+func (session *brokerSession) reply(packet packets.ControlPacket) {
+	select {
+	case session.outgoing <- packet:
+	case <-session.closed:
+	}
+}
+
+// write sends queued packets to the client. After a failed write, closing the
+// connection makes the session go away, but the queue keeps being drained
+// until it does, so reply never blocks forever.
+func (session *brokerSession) write() {
+	failed := false
+	for {
+		select {
+		case packet := <-session.outgoing:
+			if failed {
+				continue
+			}
+			session.conn.SetWriteDeadline(time.Now().Add(kBrokerWriteTimeout))
+			if err := packet.Write(session.conn); err != nil {
+				failed = true
+				session.conn.Close()
+			}
+		case <-session.closed:
+			return
+		}
+	}
+}
+
+func isValidTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// isValidTopicFilter checks that wildcards occupy entire levels, and that "#"
+// only appears as the last one.
+func isValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i == len(levels)-1 || level == "+" {
+			continue
+		}
+		if strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches reports whether the topic matches the filter. Following the
+// spec, wildcards at the first level don't match topics starting with "$".
+func topicMatches(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
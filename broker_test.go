@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"+", "", true},
+		{"a/+", "a/", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, test := range tests {
+		if got := topicMatches(test.filter, test.topic); got != test.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestIsValidTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"a/b", true},
+		{"#", true},
+		{"+", true},
+		{"a/#", true},
+		{"a/+/c", true},
+		{"+/+/#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"a#", false},
+		{"a/b+", false},
+		{"a/+b/c", false},
+	}
+	for _, test := range tests {
+		if got := isValidTopicFilter(test.filter); got != test.want {
+			t.Errorf("isValidTopicFilter(%q) = %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{"127.0.0.1:1883", true},
+		{"[::1]:1883", true},
+		{"localhost:1883", true},
+		{":1883", false},
+		{"0.0.0.0:1883", false},
+		{"192.168.1.2:1883", false},
+		{"raspberrypi:1883", false},
+	}
+	for _, test := range tests {
+		if got := isLoopbackAddr(test.listen); got != test.want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", test.listen, got, test.want)
+		}
+	}
+}
+
+func TestReadPacketLimits(t *testing.T) {
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = "scanner"
+	var buf bytes.Buffer
+	if err := connect.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPacket(bytes.NewReader(buf.Bytes()), kBrokerMaxConnectSize); err != nil {
+		t.Errorf("reading a CONNECT failed: %s", err.Error())
+	}
+
+	// A CONNECT claiming 16 MB is refused before its body is read.
+	if _, err := readPacket(bytes.NewReader([]byte{0x10, 0xff, 0xff, 0xff, 0x07}), kBrokerMaxConnectSize); err == nil {
+		t.Error("reading an oversized CONNECT succeeded")
+	}
+	// The remaining length takes four bytes at most.
+	if _, err := readPacket(bytes.NewReader([]byte{0x10, 0x80, 0x80, 0x80, 0x80, 0x01}), kBrokerMaxPacketSize); err == nil {
+		t.Error("reading a malformed remaining length succeeded")
+	}
+}
+
+var testLogger sync.Once
+
+// discardLogs silences the logger for the rest of the tests. It's only replaced
+// once, since goroutines left running by earlier tests keep using it.
+func discardLogs() {
+	testLogger.Do(func() {
+		logger = log.New(ioutil.Discard, "", 0)
+	})
+}
+
+var testBroker sync.Once
+
+// startTestBroker starts the embedded broker, shared by all tests, the first
+// time it's called. Its clients authenticate as "scanner" with "secret".
+func startTestBroker(t *testing.T) {
+	discardLogs()
+	testBroker.Do(func() {
+		cfg := &BrokerConfig{Listen: "127.0.0.1:0", Users: map[string]string{"scanner": "secret"}}
+		if err := ValidateBrokerConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		broker, err := MakeBroker(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go broker.Run()
+	})
+}
+
+func connectTestClient(t *testing.T, clientID string, password string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(embeddedBrokerURL).
+		SetClientID(clientID).
+		SetUsername("scanner").
+		SetPassword(password).
+		SetConnectRetry(false).
+		SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatalf("%s: timed out connecting", clientID)
+	}
+	return client, token.Error()
+}
+
+func waitForMessage(t *testing.T, messages <-chan mqtt.Message) mqtt.Message {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func TestBrokerRoundTrip(t *testing.T) {
+	startTestBroker(t)
+
+	if _, err := connectTestClient(t, "intruder", "wrong"); err == nil {
+		t.Error("connecting with a wrong password succeeded")
+	}
+
+	publisher, err := connectTestClient(t, "publisher", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Disconnect(0)
+	if token := publisher.Publish("plants/basil/moisture", 1, true, "42.0"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publishing the retained message failed: %v", token.Error())
+	}
+
+	subscriber, err := connectTestClient(t, "subscriber", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Disconnect(0)
+	messages := make(chan mqtt.Message, 10)
+	token := subscriber.Subscribe("plants/#", 2, func(_ mqtt.Client, msg mqtt.Message) {
+		messages <- msg
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribing failed: %v", token.Error())
+	}
+
+	msg := waitForMessage(t, messages)
+	if got := fmt.Sprintf("%s=%s retained=%v", msg.Topic(), msg.Payload(), msg.Retained()); got != "plants/basil/moisture=42.0 retained=true" {
+		t.Errorf("got %s, want the retained message", got)
+	}
+
+	// QoS 2 publishes complete their PUBREC/PUBREL/PUBCOMP exchange, and are
+	// delivered with QoS 1 at most.
+	if token := publisher.Publish("plants/basil/temperature", 2, false, "21.5"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publishing with QoS 2 failed: %v", token.Error())
+	}
+	msg = waitForMessage(t, messages)
+	if got := fmt.Sprintf("%s=%s retained=%v qos=%d", msg.Topic(), msg.Payload(), msg.Retained(), msg.Qos()); got != "plants/basil/temperature=21.5 retained=false qos=1" {
+		t.Errorf("got %s, want the QoS 2 message", got)
+	}
+}
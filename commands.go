@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Commands are published as JSON to <commands topic>/<command>, e.g.
+// parasite-scanner/cmd/rename_device with payload
+// {"id": "42", "mac": "f0:ca:f0:ca:00:01", "name": "Basil"}.
+// The optional `id` is echoed back in the reply, which is published to
+// <command replies topic>/<command>.
+type Command struct {
+	ID   string  `json:"id"`
+	MAC  MACAddr `json:"mac"`
+	Name string  `json:"name"`
+	Area string  `json:"area"`
+}
+
+type CommandReply struct {
+	ID      string      `json:"id,omitempty"`
+	Command string      `json:"command"`
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+type CommandHandler func(client *MQTTClient, cmd *Command) (interface{}, error)
+
+var kCommandHandlers = map[string]CommandHandler{
+	"reload":              reloadCommand,
+	"republish_discovery": republishDiscoveryCommand,
+	"add_device":          addDeviceCommand,
+	"rename_device":       renameDeviceCommand,
+	"pause":               pauseCommand,
+	"resume":              resumeCommand,
+	"dump_state":          dumpStateCommand,
+}
+
+// registry returns the current registry. Commands may replace it at any time,
+// but never modify it in place, so the returned map is safe to use.
+func (client *MQTTClient) registry() map[MACAddr]*MQTTParasiteConfig {
+	client.registryMu.RLock()
+	defer client.registryMu.RUnlock()
+	return client.config.Registry
+}
+
+// updateRegistry applies update to a copy of the registry and swaps it in if
+// the result is valid.
+func (client *MQTTClient) updateRegistry(update func(registry map[MACAddr]*MQTTParasiteConfig) error) error {
+	client.registryMu.Lock()
+	defer client.registryMu.Unlock()
+
+	registry := map[MACAddr]*MQTTParasiteConfig{}
+	for macAddr, deviceConfig := range client.config.Registry {
+		registry[macAddr] = deviceConfig
+	}
+	if err := update(registry); err != nil {
+		return err
+	}
+	registry, err := ValidateRegistry(registry)
+	if err != nil {
+		return err
+	}
+	client.config.Registry = registry
+	return nil
+}
+
+func (client *MQTTClient) isPaused(macAddr MACAddr) bool {
+	client.registryMu.RLock()
+	defer client.registryMu.RUnlock()
+	return client.paused[macAddr]
+}
+
+func (client *MQTTClient) setPaused(macAddr MACAddr, paused bool) {
+	client.registryMu.Lock()
+	defer client.registryMu.Unlock()
+	client.paused[macAddr] = paused
+}
+
+func (client *MQTTClient) onCommand(_ mqtt.Client, msg mqtt.Message) {
+	name := strings.TrimPrefix(msg.Topic(), client.config.CommandsTopic()+"/")
+	reply := &CommandReply{Command: name}
+
+	cmd := &Command{}
+	handler, exists := kCommandHandlers[name]
+	if !exists {
+		reply.Error = "unknown command"
+	} else if len(msg.Payload()) > 0 && json.Unmarshal(msg.Payload(), cmd) != nil {
+		reply.Error = "invalid JSON payload"
+	} else {
+		cmd.MAC = MACAddr(strings.ToLower(string(cmd.MAC)))
+		reply.ID = cmd.ID
+		logger.Printf("[mqtt] Received command %s\n", name)
+		result, err := handler(client, cmd)
+		if err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.OK = true
+			reply.Result = result
+		}
+	}
+	if reply.Error != "" {
+		logger.Printf("[mqtt] Command %s failed: %s\n", name, reply.Error)
+	}
+
+	payload, _ := json.Marshal(reply)
+	client.Publish(client.config.CommandRepliesTopic()+"/"+name, string(payload), false, 1)
+}
+
+func (client *MQTTClient) requireDevice(cmd *Command) (*MQTTParasiteConfig, error) {
+	if cmd.MAC == "" {
+		return nil, fmt.Errorf("missing mac")
+	}
+	deviceConfig, exists := client.registry()[cmd.MAC]
+	if !exists {
+		return nil, fmt.Errorf("%s is not in the registry", cmd.MAC)
+	}
+	return deviceConfig, nil
+}
+
+// reloadCommand replaces the registry with the one in the config file. Other
+// settings only take effect after a restart.
+func reloadCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	if client.reloadConfig == nil {
+		return nil, fmt.Errorf("reloading is not supported")
+	}
+	cfg, err := client.reloadConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = client.updateRegistry(func(registry map[MACAddr]*MQTTParasiteConfig) error {
+		for macAddr := range registry {
+			delete(registry, macAddr)
+		}
+		for macAddr, deviceConfig := range cfg.Registry {
+			registry[macAddr] = deviceConfig
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go client.publishDiscovery()
+	return map[string]int{"devices": len(client.registry())}, nil
+}
+
+func republishDiscoveryCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	if !client.config.AutoDiscovery {
+		return nil, fmt.Errorf("auto_discovery is disabled")
+	}
+	go client.publishDiscovery()
+	return nil, nil
+}
+
+// addDeviceCommand adds a device to the registry. Like renames, additions are
+// not written back to the config file, so they're lost on restart or reload.
+func addDeviceCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	if cmd.MAC == "" {
+		return nil, fmt.Errorf("missing mac")
+	}
+	err := client.updateRegistry(func(registry map[MACAddr]*MQTTParasiteConfig) error {
+		if _, exists := registry[cmd.MAC]; exists {
+			return fmt.Errorf("%s is already in the registry", cmd.MAC)
+		}
+		registry[cmd.MAC] = &MQTTParasiteConfig{Name: cmd.Name, Area: cmd.Area}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go client.publishDiscovery()
+	return nil, nil
+}
+
+func renameDeviceCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	if _, err := client.requireDevice(cmd); err != nil {
+		return nil, err
+	}
+	err := client.updateRegistry(func(registry map[MACAddr]*MQTTParasiteConfig) error {
+		// Copy the entry, since readers may still hold the old registry.
+		deviceConfig := *registry[cmd.MAC]
+		deviceConfig.Name = cmd.Name
+		if cmd.Area != "" {
+			deviceConfig.Area = cmd.Area
+		}
+		registry[cmd.MAC] = &deviceConfig
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go client.publishDiscovery()
+	return nil, nil
+}
+
+func pauseCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	if _, err := client.requireDevice(cmd); err != nil {
+		return nil, err
+	}
+	client.setPaused(cmd.MAC, true)
+	return nil, nil
+}
+
+func resumeCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	if _, err := client.requireDevice(cmd); err != nil {
+		return nil, err
+	}
+	client.setPaused(cmd.MAC, false)
+	return nil, nil
+}
+
+type DeviceDump struct {
+	MAC    MACAddr       `json:"mac"`
+	Name   string        `json:"name"`
+	Area   string        `json:"area,omitempty"`
+	Paused bool          `json:"paused"`
+	Online bool          `json:"online"`
+	Latest *ParasiteData `json:"latest,omitempty"`
+}
+
+func dumpStateCommand(client *MQTTClient, cmd *Command) (interface{}, error) {
+	devices := []*DeviceDump{}
+	for macAddr, deviceConfig := range client.registry() {
+		devices = append(devices, &DeviceDump{
+			MAC:    macAddr,
+			Name:   deviceConfig.Name,
+			Area:   deviceConfig.Area,
+			Paused: client.isPaused(macAddr),
+			Online: client.devices.IsOnline(macAddr),
+			Latest: client.devices.Latest(macAddr),
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MAC < devices[j].MAC })
+	return map[string]interface{}{
+		"devices": devices,
+		"stats":   stats.Snapshot(),
+	}, nil
+}
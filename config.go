@@ -3,50 +3,205 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type MACAddr string
 
-type MQTTParasiteConfig struct {
-	Name string `yaml:"name"`
+// EntityConfig overrides how one of a device's entities is presented in Home
+// Assistant.
+type EntityConfig struct {
+	Icon             string `yaml:"icon"`
+	EnabledByDefault *bool  `yaml:"enabled_by_default"`
+	Precision        *int   `yaml:"precision"`
 }
 
-const kBaseMQTTTopic string = "parasite-scanner/sensor/%s_%s/state"
+type MQTTParasiteConfig struct {
+	Name     string                   `yaml:"name"`
+	Area     string                   `yaml:"area"`
+	Model    string                   `yaml:"model"`
+	Entities map[string]*EntityConfig `yaml:"entities"`
+	// Names of the MQTT or Homie outputs the device is published to. Only used
+	// in the top-level registry. Empty means all of them.
+	Brokers []string `yaml:"brokers"`
+	// Filled in from the registry key.
+	MAC MACAddr `yaml:"-"`
+}
 
 func (cfg *MQTTParasiteConfig) NormalizedName() string {
 	return strings.Replace(strings.ToLower(cfg.Name), " ", "_", -1)
 }
 
-func (cfg *MQTTParasiteConfig) SoilMoistureTopic() string {
-	return fmt.Sprintf(kBaseMQTTTopic, cfg.NormalizedName(), "soil_moisture")
+// DeviceID identifies the device independently of its (display) name, so
+// renaming a device in the config doesn't change its identity in Home Assistant.
+func (cfg *MQTTParasiteConfig) DeviceID() string {
+	return "parasite_" + strings.Replace(string(cfg.MAC), ":", "", -1)
+}
+
+// MQTTTopicsConfig describes the topic layout. The `state`, `json_state` and
+// `device_availability` templates may use the {base}, {name} (the normalized
+// device name), {mac} (the MAC address without colons) and {metric}
+// placeholders. The `availability` template may use {base}.
+type MQTTTopicsConfig struct {
+	Base               string `yaml:"base"`
+	State              string `yaml:"state"`
+	JSONState          string `yaml:"json_state"`
+	Availability       string `yaml:"availability"`
+	DeviceAvailability string `yaml:"device_availability"`
+	DiscoveryPrefix    string `yaml:"discovery_prefix"`
+	HAStatus           string `yaml:"ha_status"`
+	Diagnostics        string `yaml:"diagnostics"`
+	Commands           string `yaml:"commands"`
+	CommandReplies     string `yaml:"command_replies"`
+}
+
+var kDefaultMQTTTopics = MQTTTopicsConfig{
+	Base:               "parasite-scanner",
+	State:              "{base}/sensor/{name}_{metric}/state",
+	JSONState:          "{base}/sensor/{name}/state",
+	Availability:       "{base}/status",
+	DeviceAvailability: "{base}/sensor/{name}/availability",
+	Diagnostics:        "{base}/bridge/diagnostics",
+	Commands:           "{base}/cmd",
+	CommandReplies:     "{base}/cmd_reply",
+	DiscoveryPrefix:    "homeassistant",
+}
+
+// In change-only mode, metrics are published at least this often, unless
+// heartbeat_interval is set.
+const kDefaultHeartbeatInterval = 1 * time.Hour
+
+// Diagnostics are published this often, unless diagnostics_interval is set.
+// A negative interval disables them.
+const kDefaultDiagnosticsInterval = 1 * time.Minute
+
+func (cfg *MQTTConfig) expandTopic(template string, deviceConfig *MQTTParasiteConfig, metric string) string {
+	replacements := []string{"{base}", cfg.Topics.Base, "{metric}", metric}
+	if deviceConfig != nil {
+		replacements = append(replacements,
+			"{name}", deviceConfig.NormalizedName(),
+			"{mac}", strings.Replace(string(deviceConfig.MAC), ":", "", -1))
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// MetricTopic is the topic a single metric is published to, in the "plain"
+// payload format.
+func (cfg *MQTTConfig) MetricTopic(deviceConfig *MQTTParasiteConfig, metric string) string {
+	return cfg.expandTopic(cfg.Topics.State, deviceConfig, metric)
+}
+
+// StateTopic is the topic all metrics are published to at once, in the "json"
+// payload format.
+func (cfg *MQTTConfig) StateTopic(deviceConfig *MQTTParasiteConfig) string {
+	return cfg.expandTopic(cfg.Topics.JSONState, deviceConfig, "")
+}
+
+// AvailabilityTopic holds the scanner's "online"/"offline" status.
+func (cfg *MQTTConfig) AvailabilityTopic() string {
+	return cfg.expandTopic(cfg.Topics.Availability, nil, "")
+}
+
+// DeviceAvailabilityTopic holds a device's "online"/"offline" status, based on
+// when it was last heard from.
+func (cfg *MQTTConfig) DeviceAvailabilityTopic(deviceConfig *MQTTParasiteConfig) string {
+	return cfg.expandTopic(cfg.Topics.DeviceAvailability, deviceConfig, "")
+}
+
+// DiagnosticsTopic holds the scanner's periodic diagnostics.
+func (cfg *MQTTConfig) DiagnosticsTopic() string {
+	return cfg.expandTopic(cfg.Topics.Diagnostics, nil, "")
+}
+
+// CommandsTopic is the prefix of the topics commands are received on.
+func (cfg *MQTTConfig) CommandsTopic() string {
+	return cfg.expandTopic(cfg.Topics.Commands, nil, "")
+}
+
+// CommandRepliesTopic is the prefix of the topics command replies are
+// published to.
+func (cfg *MQTTConfig) CommandRepliesTopic() string {
+	return cfg.expandTopic(cfg.Topics.CommandReplies, nil, "")
+}
+
+// HAStatusTopic is where Home Assistant announces that it came online.
+func (cfg *MQTTConfig) HAStatusTopic() string {
+	if cfg.Topics.HAStatus != "" {
+		return cfg.Topics.HAStatus
+	}
+	return cfg.Topics.DiscoveryPrefix + "/status"
+}
+
+// DiscoveryNodeID groups our discovery messages under the discovery prefix.
+// It's derived from the base topic so that scanners sharing a broker don't
+// overwrite each other's discovery messages.
+func (cfg *MQTTConfig) DiscoveryNodeID() string {
+	return strings.Replace(cfg.Topics.Base, "/", "_", -1)
+}
+
+// TLSConfig configures TLS for ssl://, mqtts:// and wss:// brokers. Setting
+// `cert_file` and `key_file` enables client certificate (mutual TLS)
+// authentication.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name"`
 }
 
-func (cfg *MQTTParasiteConfig) TemperatureTopic() string {
-	return fmt.Sprintf(kBaseMQTTTopic, cfg.NormalizedName(), "temperature")
+// MetricConfig controls how a metric is published. `precision` is the number of
+// decimals, and `deadband` is how much the metric has to change before it's
+// published again in change-only mode.
+type MetricConfig struct {
+	Precision *int    `yaml:"precision"`
+	Deadband  float64 `yaml:"deadband"`
 }
 
-func (cfg *MQTTParasiteConfig) HumidityTopic() string {
-	return fmt.Sprintf(kBaseMQTTTopic, cfg.NormalizedName(), "humidity")
+// FormatMetric formats a metric's value for publishing.
+func (cfg *MQTTConfig) FormatMetric(metric *MQTTMetric, value float64) string {
+	if metricConfig := cfg.Metrics[metric.Key]; metricConfig != nil && metricConfig.Precision != nil {
+		return strconv.FormatFloat(value, 'f', *metricConfig.Precision, 64)
+	}
+	return fmt.Sprintf(metric.Format, value)
 }
 
-func (cfg *MQTTParasiteConfig) BatteryVoltageTopic() string {
-	return fmt.Sprintf(kBaseMQTTTopic, cfg.NormalizedName(), "battery_voltage")
+// RoundMetric rounds a metric's value the same way FormatMetric does.
+func (cfg *MQTTConfig) RoundMetric(metric *MQTTMetric, value float64) float64 {
+	rounded, _ := strconv.ParseFloat(cfg.FormatMetric(metric, value), 64)
+	return rounded
 }
 
-func (cfg *MQTTParasiteConfig) RSSITopic() string {
-	return fmt.Sprintf(kBaseMQTTTopic, cfg.NormalizedName(), "rssi")
+// OfflineBufferConfig configures a disk-backed queue that holds readings while
+// the broker is unreachable. They are replayed in order once it's back.
+type OfflineBufferConfig struct {
+	Path    string        `yaml:"path"`
+	MaxSize int           `yaml:"max_size"`
+	MaxAge  time.Duration `yaml:"max_age"`
 }
 
 type MQTTConfig struct {
-	Host          string                          `yaml:"host"`
-	Username      string                          `yaml:"username"`
-	Password      string                          `yaml:"password"`
-	ClientId      string                          `yaml:"client_id"`
-	AutoDiscovery bool                            `yaml:"auto_discovery"`
-	Registry      map[MACAddr]*MQTTParasiteConfig `yaml:"registry"`
+	Host                      string                          `yaml:"host"`
+	Username                  string                          `yaml:"username"`
+	Password                  string                          `yaml:"password"`
+	ClientId                  string                          `yaml:"client_id"`
+	TLS                       *TLSConfig                      `yaml:"tls"`
+	OfflineBuffer             *OfflineBufferConfig            `yaml:"offline_buffer"`
+	PayloadFormat             string                          `yaml:"payload_format"`
+	Topics                    MQTTTopicsConfig                `yaml:"topics"`
+	StateFile                 string                          `yaml:"state_file"`
+	DeviceAvailabilityTimeout time.Duration                   `yaml:"device_availability_timeout"`
+	DiagnosticsInterval       time.Duration                   `yaml:"diagnostics_interval"`
+	Commands                  bool                            `yaml:"commands"`
+	Metrics                   map[string]*MetricConfig        `yaml:"metrics"`
+	ChangeOnly                bool                            `yaml:"change_only"`
+	HeartbeatInterval         time.Duration                   `yaml:"heartbeat_interval"`
+	AutoDiscovery             bool                            `yaml:"auto_discovery"`
+	Registry                  map[MACAddr]*MQTTParasiteConfig `yaml:"registry"`
 }
 
 type BLEConfig struct {
@@ -54,20 +209,242 @@ type BLEConfig struct {
 		InferMACAddress  bool   `yaml:"infer_mac_address"`
 		MACAddressPrefix string `yaml:"mac_address_prefix"`
 	} `yaml:"macos"`
+	// Whether to decode b-parasite advertisements. Defaults to true.
+	Decode  *bool             `yaml:"decode"`
+	Gateway *BLEGatewayConfig `yaml:"gateway"`
+}
+
+func ValidateBLEConfig(cfg *BLEConfig) error {
+	if cfg.Decode == nil {
+		decode := true
+		cfg.Decode = &decode
+	}
+	if cfg.Gateway != nil {
+		if err := ValidateBLEGatewayConfig(cfg.Gateway); err != nil {
+			return fmt.Errorf("gateway: %s", err.Error())
+		}
+	}
+	return nil
 }
 
 type Config struct {
-	MQTT MQTTConfig `yaml:"mqtt"`
-	BLE  BLEConfig
+	MQTT    MQTTConfig `yaml:"mqtt"`
+	BLE     BLEConfig
+	Outputs []*OutputConfig `yaml:"outputs"`
+	Sources []*SourceConfig `yaml:"sources"`
+	// How long to wait for further copies of an advertisement, e.g. received
+	// by satellites, so the one with the best RSSI is kept.
+	DedupWindow time.Duration `yaml:"dedup_window"`
+	// If set, runs an MQTT broker in-process.
+	Broker *BrokerConfig `yaml:"broker"`
+	// If set, only the elected leader among redundant scanners publishes.
+	Leader *LeaderConfig `yaml:"leader"`
+	// Shared by MQTT and Homie outputs that don't have a registry of their own.
+	Registry map[MACAddr]*MQTTParasiteConfig `yaml:"registry"`
+}
+
+// The name the top-level `mqtt` section goes by in registry entries' `brokers`.
+const kLegacyMQTTName = "mqtt"
+
+// RegistryFor returns the entries of the top-level registry that are routed to
+// the MQTT or Homie output with the given name.
+func (config *Config) RegistryFor(output string) map[MACAddr]*MQTTParasiteConfig {
+	registry := map[MACAddr]*MQTTParasiteConfig{}
+	for macAddr, deviceConfig := range config.Registry {
+		if len(deviceConfig.Brokers) == 0 {
+			registry[macAddr] = deviceConfig
+		}
+		for _, broker := range deviceConfig.Brokers {
+			if broker == output {
+				registry[macAddr] = deviceConfig
+			}
+		}
+	}
+	return registry
+}
+
+// validateRouting checks that registry entries are only routed to MQTT or Homie
+// outputs that exist.
+func (config *Config) validateRouting() error {
+	brokers := map[string]bool{}
+	if config.MQTT.Host != "" {
+		brokers[kLegacyMQTTName] = true
+	}
+	for _, output := range config.Outputs {
+		if output.Type == "mqtt" || output.Type == "homie" {
+			brokers[output.Name] = true
+		}
+	}
+	for macAddr, deviceConfig := range config.Registry {
+		for _, broker := range deviceConfig.Brokers {
+			if !brokers[broker] {
+				return fmt.Errorf("registry: %s: unknown broker %q", macAddr, broker)
+			}
+		}
+	}
+	return nil
+}
+
+// validateStateFiles checks that MQTT outputs with auto-discovery don't share a
+// state file, in which they'd overwrite each other's record of the discovery
+// topics they published.
+func (config *Config) validateStateFiles() error {
+	owners := map[string]string{}
+	if config.MQTT.Host != "" && config.MQTT.AutoDiscovery {
+		owners[config.MQTT.StateFile] = kLegacyMQTTName
+	}
+	for _, output := range config.Outputs {
+		if output.Type != "mqtt" {
+			continue
+		}
+		mqttCfg, err := decodeMQTTConfig(output)
+		if err != nil {
+			return fmt.Errorf("output %s: %s", output.Name, err.Error())
+		}
+		if !mqttCfg.AutoDiscovery {
+			continue
+		}
+		if owner, exists := owners[mqttCfg.StateFile]; exists {
+			return fmt.Errorf("output %s: state_file %s is already used by %s", output.Name, mqttCfg.StateFile, owner)
+		}
+		owners[mqttCfg.StateFile] = output.Name
+	}
+	return nil
 }
 
 func ValidateMQTTParasiteConfig(cfg *MQTTParasiteConfig) error {
 	if cfg.Name == "" {
 		return fmt.Errorf("missing name")
 	}
+	for entity := range cfg.Entities {
+		if !isValidEntity(entity) {
+			return fmt.Errorf("unknown entity %q", entity)
+		}
+	}
+	return nil
+}
+
+func isValidEntity(entity string) bool {
+	if entity == kLastSeenEntity {
+		return true
+	}
+	for _, metric := range kMQTTMetrics {
+		if metric.Key == entity {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTLSConfig checks that a client certificate comes with its key. cfg
+// may be nil, when TLS isn't configured.
+func ValidateTLSConfig(cfg *TLSConfig) error {
+	if cfg != nil && (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
 	return nil
 }
 
+// ValidateMQTTConfig validates the registry entries and normalizes their MAC
+// addresses (to lowercase).
+func ValidateMQTTConfig(cfg *MQTTConfig) error {
+	if err := ValidateTLSConfig(cfg.TLS); err != nil {
+		return fmt.Errorf("tls: %s", err.Error())
+	}
+	switch cfg.PayloadFormat {
+	case "":
+		cfg.PayloadFormat = "plain"
+	case "plain", "json":
+	default:
+		return fmt.Errorf("invalid payload_format: %s", cfg.PayloadFormat)
+	}
+	if cfg.OfflineBuffer != nil && cfg.OfflineBuffer.Path == "" {
+		return fmt.Errorf("offline_buffer: missing path")
+	}
+	if cfg.Topics.Base == "" {
+		cfg.Topics.Base = kDefaultMQTTTopics.Base
+	}
+	if cfg.Topics.State == "" {
+		cfg.Topics.State = kDefaultMQTTTopics.State
+	}
+	if cfg.Topics.JSONState == "" {
+		cfg.Topics.JSONState = kDefaultMQTTTopics.JSONState
+	}
+	if cfg.Topics.Availability == "" {
+		cfg.Topics.Availability = kDefaultMQTTTopics.Availability
+	}
+	if cfg.Topics.DeviceAvailability == "" {
+		cfg.Topics.DeviceAvailability = kDefaultMQTTTopics.DeviceAvailability
+	}
+	if cfg.Topics.Diagnostics == "" {
+		cfg.Topics.Diagnostics = kDefaultMQTTTopics.Diagnostics
+	}
+	if cfg.Topics.Commands == "" {
+		cfg.Topics.Commands = kDefaultMQTTTopics.Commands
+	}
+	if cfg.Topics.CommandReplies == "" {
+		cfg.Topics.CommandReplies = kDefaultMQTTTopics.CommandReplies
+	}
+	if strings.HasPrefix(cfg.Topics.CommandReplies+"/", cfg.Topics.Commands+"/") {
+		return fmt.Errorf("topics: command_replies must not be under commands")
+	}
+	for key, metricConfig := range cfg.Metrics {
+		if key == kLastSeenEntity || !isValidEntity(key) {
+			return fmt.Errorf("metrics: unknown metric %q", key)
+		}
+		if metricConfig.Precision != nil && (*metricConfig.Precision < 0 || *metricConfig.Precision > 6) {
+			return fmt.Errorf("metrics: %s: precision must be between 0 and 6", key)
+		}
+		if metricConfig.Deadband < 0 {
+			return fmt.Errorf("metrics: %s: deadband must not be negative", key)
+		}
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = kDefaultHeartbeatInterval
+	}
+	if cfg.DiagnosticsInterval == 0 {
+		cfg.DiagnosticsInterval = kDefaultDiagnosticsInterval
+	}
+	if cfg.Topics.DiscoveryPrefix == "" {
+		cfg.Topics.DiscoveryPrefix = kDefaultMQTTTopics.DiscoveryPrefix
+	}
+	if !strings.Contains(cfg.Topics.State, "{metric}") {
+		return fmt.Errorf("topics: state must contain the {metric} placeholder")
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = cfg.DiscoveryNodeID() + "-discovery.json"
+	}
+	registry, err := ValidateRegistry(cfg.Registry)
+	if err != nil {
+		return err
+	}
+	cfg.Registry = registry
+	return nil
+}
+
+// ValidateRegistry validates the registry entries and returns a copy of the
+// registry with normalized MAC addresses (lowercase).
+func ValidateRegistry(registry map[MACAddr]*MQTTParasiteConfig) (map[MACAddr]*MQTTParasiteConfig, error) {
+	normalized := map[MACAddr]*MQTTParasiteConfig{}
+	// Devices with names that normalize to the same string would share topics.
+	normalizedNames := map[string]MACAddr{}
+	for macAddr, mqttCfg := range registry {
+		if err := ValidateMQTTParasiteConfig(mqttCfg); err != nil {
+			return nil, fmt.Errorf("%s: %s", macAddr, err.Error())
+		}
+		if other, exists := normalizedNames[mqttCfg.NormalizedName()]; exists {
+			return nil, fmt.Errorf("%s: name %q collides with the name of %s (both normalize to %q)", macAddr, mqttCfg.Name, other, mqttCfg.NormalizedName())
+		}
+		normalizedNames[mqttCfg.NormalizedName()] = macAddr
+		// The entries may be in use by outputs reading them concurrently, so
+		// they're copied rather than modified.
+		copied := *mqttCfg
+		copied.MAC = MACAddr(strings.ToLower(string(macAddr)))
+		normalized[copied.MAC] = &copied
+	}
+	return normalized, nil
+}
+
 func ParseConfig(filename string) (*Config, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -82,14 +459,47 @@ func ParseConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	for macAddr, mqttCfg := range config.MQTT.Registry {
-		if err := ValidateMQTTParasiteConfig(mqttCfg); err != nil {
-			return nil, fmt.Errorf("%s: %s", macAddr, err.Error())
+	registry, err := ValidateRegistry(config.Registry)
+	if err != nil {
+		return nil, fmt.Errorf("registry: %s", err.Error())
+	}
+	config.Registry = registry
+	if len(config.MQTT.Registry) == 0 {
+		config.MQTT.Registry = config.RegistryFor(kLegacyMQTTName)
+	}
+	if err := ValidateMQTTConfig(&config.MQTT); err != nil {
+		return nil, err
+	}
+	if err := ValidateBLEConfig(&config.BLE); err != nil {
+		return nil, fmt.Errorf("ble: %s", err.Error())
+	}
+	if config.Broker != nil {
+		if err := ValidateBrokerConfig(config.Broker); err != nil {
+			return nil, fmt.Errorf("broker: %s", err.Error())
+		}
+	}
+	if config.Leader != nil {
+		if err := ValidateLeaderConfig(config.Leader); err != nil {
+			return nil, fmt.Errorf("leader: %s", err.Error())
 		}
-		// Normalize MAC address (to lowercase).
-		delete(config.MQTT.Registry, macAddr)
-		normalizedMACAddr := strings.ToLower(string(macAddr))
-		config.MQTT.Registry[MACAddr(normalizedMACAddr)] = mqttCfg
+	}
+	if err := ValidateOutputConfigs(config, config.Outputs); err != nil {
+		return nil, err
+	}
+	if err := ValidateSourceConfigs(config); err != nil {
+		return nil, err
+	}
+	if config.DedupWindow < 0 {
+		return nil, fmt.Errorf("dedup_window must not be negative")
+	}
+	if config.DedupWindow == 0 && config.HasSource("satellites") {
+		config.DedupWindow = kDefaultSatelliteDedupWindow
+	}
+	if err := config.validateRouting(); err != nil {
+		return nil, err
+	}
+	if err := config.validateStateFiles(); err != nil {
+		return nil, err
 	}
 	return config, nil
 }
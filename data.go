@@ -1,13 +1,15 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"time"
 )
 
 // ParasiteData is the main currency in parasite-scanner.
-// The BLE scanner listens for b-parasite broadcasts and instantiate a ParasiteData
-// object whenever a valid message is received, after deduplication.
+// Sources, like the BLE scanner, instantiate a ParasiteData object whenever a
+// valid message is received, which is then fed to consumers after
+// deduplication.
 // Consumers of ParasiteData should implement the DataSubscriber interface below, and
 // will be fed new data upon arrival.
 type ParasiteData struct {
@@ -19,18 +21,81 @@ type ParasiteData struct {
 	SoilMoisture   float32
 	Time           time.Time
 	RSSI           int
+	// Only set for readings computed by an Aggregator.
+	Aggregate *AggregateStats `json:",omitempty"`
+	// The ID of the satellite (or the name of the source, e.g. for ESPHome) that
+	// received the reading. Empty for readings received locally.
+	Satellite string `json:",omitempty"`
+	// Set for readings that weren't decoded from an advertisement, e.g. the
+	// ones received from ESPHome. Those have no counter to deduplicate by.
+	NoCounter bool `json:",omitempty"`
+	// The metrics (by their kMQTTMetrics key) the reading has no value for, e.g.
+	// because its source doesn't provide them. Outputs leave them out.
+	Missing []string `json:",omitempty"`
+	// The advertisement the reading was decoded from, if it's at hand.
+	Advertisement *RawAdvertisement `json:"-"`
+}
+
+// RawAdvertisement is a b-parasite advertisement as received, before decoding.
+type RawAdvertisement struct {
+	Address string `json:"address"`
+	RSSI    int    `json:"rssi"`
+	// Hex-encoded.
+	ServiceData string    `json:"service_data"`
+	Time        time.Time `json:"time"`
+}
+
+// Decode decodes the advertisement like the BLE scanner does with the ones it
+// receives.
+func (adv *RawAdvertisement) Decode(cfg *BLEConfig) (*ParasiteData, error) {
+	serviceData, err := hex.DecodeString(adv.ServiceData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service data: %s", err.Error())
+	}
+	data, err := decodeParasiteData(cfg, adv.Address, serviceData, adv.RSSI)
+	if err != nil {
+		return nil, err
+	}
+	if !adv.Time.IsZero() {
+		data.Time = adv.Time
+	}
+	data.Advertisement = adv
+	return data, nil
+}
+
+// The receiver name of readings received locally, as opposed to by a satellite.
+const kLocalReceiver = "local"
+
+// Receiver returns the ID of the satellite that received the reading, or
+// kLocalReceiver.
+func (pd *ParasiteData) Receiver() string {
+	if pd.Satellite == "" {
+		return kLocalReceiver
+	}
+	return pd.Satellite
+}
+
+// HasMetric reports whether the reading has a value for the metric.
+func (pd *ParasiteData) HasMetric(key string) bool {
+	for _, missing := range pd.Missing {
+		if missing == key {
+			return false
+		}
+	}
+	return true
 }
 
 func (pd ParasiteData) String() string {
 	return fmt.Sprintf(
-		"%s | soil: %5.1f%% | batt: %3.1fV | temp: %4.1fC | humi: %5.1f%% | %6.1fs ago | counter: %d",
+		"%s | soil: %5.1f%% | batt: %3.1fV | temp: %4.1fC | humi: %5.1f%% | %6.1fs ago | counter: %d | via: %s",
 		pd.Key,
 		pd.SoilMoisture,
 		pd.BatteryVoltage,
 		pd.TempCelcius,
 		pd.Humidity,
 		time.Since(pd.Time).Seconds(),
-		pd.Counter)
+		pd.Counter,
+		pd.Receiver())
 }
 
 type DataSubscriber interface {
@@ -39,3 +104,9 @@ type DataSubscriber interface {
 	// A function that will be called whenever new data is available.
 	Ingest(data *ParasiteData)
 }
+
+type DataSource interface {
+	// A blocking function that will be called on its own go routine. Readings
+	// are sent to sink as they're received.
+	Run(sink chan<- *ParasiteData)
+}
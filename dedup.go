@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Deduplicator drops readings that were already received, based on the
+// wrap-around counter in b-parasite advertisements. The same advertisement may
+// be received several times, by the local adapter as well as by satellites.
+// With a window, the first copy of an advertisement is held back for that
+// long, and the copy with the best RSSI is let through. Without one, the first
+// copy is let through right away. Readings without a counter are always let
+// through.
+type Deduplicator struct {
+	mu          sync.Mutex
+	window      time.Duration
+	lastCounter map[string]uint8
+	pending     map[string]*ParasiteData
+	out         chan *ParasiteData
+}
+
+func MakeDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window:      window,
+		lastCounter: map[string]uint8{},
+		pending:     map[string]*ParasiteData{},
+		out:         make(chan *ParasiteData),
+	}
+}
+
+// Run deduplicates the readings received from in, sending the remaining ones
+// to dedup.out.
+func (dedup *Deduplicator) Run(in <-chan *ParasiteData) {
+	for data := range in {
+		if data.NoCounter {
+			dedup.emit([]*ParasiteData{data})
+			continue
+		}
+		stats.RecordReception(data.Key, data.Receiver(), data.RSSI)
+		if emit := dedup.offer(data); emit != nil {
+			dedup.emit(emit)
+		}
+	}
+}
+
+// offer returns the readings to let through right away.
+func (dedup *Deduplicator) offer(data *ParasiteData) []*ParasiteData {
+	dedup.mu.Lock()
+	defer dedup.mu.Unlock()
+
+	if pending, exists := dedup.pending[data.Key]; exists && pending.Counter == data.Counter {
+		if data.RSSI > pending.RSSI {
+			dedup.pending[data.Key] = data
+		}
+		return nil
+	}
+	// Have we processed this data already?
+	if oldCounter, exists := dedup.lastCounter[data.Key]; exists && oldCounter == data.Counter {
+		logger.Println("[dedup] Skipping already processed data (based on counter):", data)
+		return nil
+	}
+	dedup.lastCounter[data.Key] = data.Counter
+
+	emit := []*ParasiteData{}
+	// A newer advertisement makes the pending one final.
+	if pending, exists := dedup.pending[data.Key]; exists {
+		delete(dedup.pending, data.Key)
+		emit = append(emit, pending)
+	}
+	if dedup.window == 0 {
+		return append(emit, data)
+	}
+	dedup.pending[data.Key] = data
+	time.AfterFunc(dedup.window, func() { dedup.flush(data.Key, data.Counter) })
+	return emit
+}
+
+// flush lets the pending reading of a device through, unless it was already.
+func (dedup *Deduplicator) flush(key string, counter uint8) {
+	dedup.mu.Lock()
+	pending, exists := dedup.pending[key]
+	if !exists || pending.Counter != counter {
+		dedup.mu.Unlock()
+		return
+	}
+	delete(dedup.pending, key)
+	dedup.mu.Unlock()
+	dedup.emit([]*ParasiteData{pending})
+}
+
+func (dedup *Deduplicator) emit(readings []*ParasiteData) {
+	for _, data := range readings {
+		stats.RecordDevice(data.Key)
+		dedup.out <- data
+	}
+}
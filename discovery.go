@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+)
+
+// AutoDiscoveryDeviceInfo groups entities into devices in Home Assistant.
+// Each b-parasite is its own device, identified by its MAC address, which is
+// connected to Home Assistant via the scanner's bridge device.
+type AutoDiscoveryDeviceInfo struct {
+	Identifiers   []string   `json:"identifiers,omitempty"`
+	Connections   [][]string `json:"connections,omitempty"`
+	Name          string     `json:"name"`
+	Manufacturer  string     `json:"manufacturer"`
+	Model         string     `json:"model,omitempty"`
+	SuggestedArea string     `json:"suggested_area,omitempty"`
+	ViaDevice     string     `json:"via_device,omitempty"`
+	SWVersion     string     `json:"sw_version,omitempty"`
+}
+
+type AutoDiscoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type AutoDiscoveryPayload struct {
+	DeviceClass       string                       `json:"device_class,omitempty"`
+	UnitOfMeasument   string                       `json:"unit_of_measurement,omitempty"`
+	Name              string                       `json:"name"`
+	StateTopic        string                       `json:"state_topic"`
+	ValueTemplate     string                       `json:"value_template,omitempty"`
+	PayloadOn         string                       `json:"payload_on,omitempty"`
+	PayloadOff        string                       `json:"payload_off,omitempty"`
+	AvailabilityTopic string                       `json:"availability_topic,omitempty"`
+	Availability      []*AutoDiscoveryAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string                       `json:"availability_mode,omitempty"`
+	ExpireAfter       int                          `json:"expire_after,omitempty"`
+	StateClass        string                       `json:"state_class,omitempty"`
+	EntityCategory    string                       `json:"entity_category,omitempty"`
+	Icon              string                       `json:"icon,omitempty"`
+	EnabledByDefault  *bool                        `json:"enabled_by_default,omitempty"`
+	DisplayPrecision  *int                         `json:"suggested_display_precision,omitempty"`
+	UniqueID          string                       `json:"unique_id"`
+	Device            *AutoDiscoveryDeviceInfo     `json:"device"`
+}
+
+type AutoDiscoveryMsg struct {
+	Topic   string
+	Payload AutoDiscoveryPayload
+}
+
+const kDefaultModel = "b-parasite"
+
+func (cfg *MQTTConfig) discoveryTopic(component string, objectID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", cfg.Topics.DiscoveryPrefix, component, cfg.DiscoveryNodeID(), objectID)
+}
+
+// The bridge device represents the scanner itself.
+func makeBridgeDeviceInfo(cfg *MQTTConfig) *AutoDiscoveryDeviceInfo {
+	return &AutoDiscoveryDeviceInfo{
+		Identifiers:  []string{cfg.DiscoveryNodeID()},
+		Name:         cfg.Topics.Base,
+		Manufacturer: "rbaron",
+		Model:        "parasite-scanner",
+		SWVersion:    version,
+	}
+}
+
+func makeDeviceInfo(cfg *MQTTConfig, deviceConfig *MQTTParasiteConfig) *AutoDiscoveryDeviceInfo {
+	model := deviceConfig.Model
+	if model == "" {
+		model = kDefaultModel
+	}
+	return &AutoDiscoveryDeviceInfo{
+		Identifiers:   []string{deviceConfig.DeviceID()},
+		Connections:   [][]string{{"mac", string(deviceConfig.MAC)}},
+		Name:          deviceConfig.Name,
+		Manufacturer:  "rbaron",
+		Model:         model,
+		SuggestedArea: deviceConfig.Area,
+		ViaDevice:     cfg.DiscoveryNodeID(),
+	}
+}
+
+// BridgeEntity is one of the fields of StatsSnapshot, exposed as an entity of
+// the bridge device.
+type BridgeEntity struct {
+	Key         string
+	Name        string
+	DeviceClass string
+	Unit        string
+	StateClass  string
+}
+
+var kBridgeEntities = []*BridgeEntity{
+	{Key: "uptime", Name: "Uptime", DeviceClass: "duration", Unit: "s", StateClass: "measurement"},
+	{Key: "adapter_state", Name: "Adapter State"},
+	{Key: "advertisements_per_minute", Name: "Advertisements", Unit: "adv/min", StateClass: "measurement"},
+	{Key: "parasite_advertisements_per_minute", Name: "b-parasite Advertisements", Unit: "adv/min", StateClass: "measurement"},
+	{Key: "decode_errors", Name: "Decode Errors", StateClass: "total_increasing"},
+	{Key: "unique_devices", Name: "Devices Heard", StateClass: "measurement"},
+	{Key: "publish_failures", Name: "Publish Failures", StateClass: "total_increasing"},
+}
+
+// makeBridgeAutoDiscoveryMessages announces the bridge device through a
+// connectivity sensor that mirrors the scanner's availability topic, and
+// sensors for the most useful diagnostics.
+func makeBridgeAutoDiscoveryMessages(cfg *MQTTConfig) []*AutoDiscoveryMsg {
+	device := makeBridgeDeviceInfo(cfg)
+	msgs := []*AutoDiscoveryMsg{
+		{Topic: cfg.discoveryTopic("binary_sensor", "bridge_status"),
+			Payload: AutoDiscoveryPayload{
+				DeviceClass: "connectivity",
+				Name:        fmt.Sprintf("%s Status", cfg.Topics.Base),
+				StateTopic:  cfg.AvailabilityTopic(),
+				PayloadOn:   "online",
+				PayloadOff:  "offline",
+				UniqueID:    fmt.Sprintf("%s_bridge_status", cfg.DiscoveryNodeID()),
+				Device:      device,
+			}},
+	}
+	if cfg.DiagnosticsInterval < 0 {
+		return msgs
+	}
+	for _, entity := range kBridgeEntities {
+		msgs = append(msgs, &AutoDiscoveryMsg{
+			Topic: cfg.discoveryTopic("sensor", "bridge_"+entity.Key),
+			Payload: AutoDiscoveryPayload{
+				DeviceClass:       entity.DeviceClass,
+				UnitOfMeasument:   entity.Unit,
+				Name:              fmt.Sprintf("%s %s", cfg.Topics.Base, entity.Name),
+				StateTopic:        cfg.DiagnosticsTopic(),
+				ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", entity.Key),
+				AvailabilityTopic: cfg.AvailabilityTopic(),
+				StateClass:        entity.StateClass,
+				EntityCategory:    "diagnostic",
+				UniqueID:          fmt.Sprintf("%s_bridge_%s", cfg.DiscoveryNodeID(), entity.Key),
+				Device:            device,
+			}})
+	}
+	return msgs
+}
+
+func makeAutoDiscoveryMessages(cfg *MQTTConfig, deviceConfig *MQTTParasiteConfig) []*AutoDiscoveryMsg {
+	device := makeDeviceInfo(cfg, deviceConfig)
+	msgs := []*AutoDiscoveryMsg{}
+	for _, metric := range kMQTTMetrics {
+		payload := AutoDiscoveryPayload{
+			DeviceClass:       metric.DeviceClass,
+			UnitOfMeasument:   metric.Unit,
+			Name:              fmt.Sprintf("%s %s", deviceConfig.Name, metric.Name),
+			StateTopic:        cfg.MetricTopic(deviceConfig, metric.Key),
+			UniqueID:          fmt.Sprintf("%s_%s", deviceConfig.DeviceID(), metric.Key),
+			AvailabilityTopic: cfg.AvailabilityTopic(),
+			StateClass:        "measurement",
+			Device:            device,
+		}
+		if metric.Diagnostic {
+			payload.EntityCategory = "diagnostic"
+		}
+		// With per-device availability, entities are only available while both
+		// the scanner and the device are.
+		if cfg.DeviceAvailabilityTimeout > 0 {
+			payload.AvailabilityTopic = ""
+			payload.Availability = []*AutoDiscoveryAvailability{
+				{Topic: cfg.AvailabilityTopic()},
+				{Topic: cfg.DeviceAvailabilityTopic(deviceConfig)},
+			}
+			payload.AvailabilityMode = "all"
+			// In change-only mode, metrics may go unpublished for up to
+			// heartbeat_interval while the device is perfectly healthy.
+			if !cfg.ChangeOnly {
+				payload.ExpireAfter = int(cfg.DeviceAvailabilityTimeout.Seconds())
+			}
+		}
+		if cfg.PayloadFormat == "json" {
+			payload.StateTopic = cfg.StateTopic(deviceConfig)
+			payload.ValueTemplate = fmt.Sprintf("{{ value_json.%s }}", metric.Key)
+		}
+		applyEntityConfig(&payload, deviceConfig.Entities[metric.Key])
+		msgs = append(msgs, &AutoDiscoveryMsg{
+			Topic:   cfg.discoveryTopic("sensor", fmt.Sprintf("%s_%s", deviceConfig.DeviceID(), metric.Key)),
+			Payload: payload,
+		})
+	}
+
+	// The "last seen" entity stays available while the device is silent, since
+	// that's precisely when it's most interesting.
+	lastSeen := AutoDiscoveryPayload{
+		DeviceClass:       "timestamp",
+		Name:              fmt.Sprintf("%s Last Seen", deviceConfig.Name),
+		StateTopic:        cfg.MetricTopic(deviceConfig, kTimestampMetric),
+		UniqueID:          fmt.Sprintf("%s_%s", deviceConfig.DeviceID(), kLastSeenEntity),
+		AvailabilityTopic: cfg.AvailabilityTopic(),
+		EntityCategory:    "diagnostic",
+		Device:            device,
+	}
+	// In change-only mode, the timestamp has a topic of its own in the json
+	// format as well, since the document isn't published for every reading.
+	if cfg.PayloadFormat == "json" && !cfg.ChangeOnly {
+		lastSeen.StateTopic = cfg.StateTopic(deviceConfig)
+		lastSeen.ValueTemplate = fmt.Sprintf("{{ value_json.%s }}", kTimestampMetric)
+	}
+	applyEntityConfig(&lastSeen, deviceConfig.Entities[kLastSeenEntity])
+	msgs = append(msgs, &AutoDiscoveryMsg{
+		Topic:   cfg.discoveryTopic("sensor", fmt.Sprintf("%s_%s", deviceConfig.DeviceID(), kLastSeenEntity)),
+		Payload: lastSeen,
+	})
+	return msgs
+}
+
+// applyEntityConfig applies the per-entity overrides from the registry.
+func applyEntityConfig(payload *AutoDiscoveryPayload, entityConfig *EntityConfig) {
+	if entityConfig == nil {
+		return
+	}
+	if entityConfig.Icon != "" {
+		payload.Icon = entityConfig.Icon
+	}
+	payload.EnabledByDefault = entityConfig.EnabledByDefault
+	payload.DisplayPrecision = entityConfig.Precision
+}
+
+// legacyDiscoveryTopics are the discovery topics used before object IDs were
+// derived from MAC addresses. They are cleared when a device is seen for the
+// first time, so upgrading doesn't leave duplicate entities behind.
+func legacyDiscoveryTopics(cfg *MQTTConfig, deviceConfig *MQTTParasiteConfig) []string {
+	topics := []string{}
+	for _, metric := range kMQTTMetrics {
+		topics = append(topics, cfg.discoveryTopic("sensor", fmt.Sprintf("%s_%s", deviceConfig.NormalizedName(), metric.Key)))
+	}
+	return topics
+}
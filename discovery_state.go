@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// DiscoveryState remembers which discovery topics were published for each
+// device, so that stale ones can be cleared on the next run (e.g. after a
+// device is renamed).
+type DiscoveryState struct {
+	Devices map[MACAddr]*DiscoveredDevice `json:"devices"`
+}
+
+type DiscoveredDevice struct {
+	Name   string   `json:"name"`
+	Topics []string `json:"topics"`
+}
+
+// LoadDiscoveryState reads the state file. A missing file yields an empty state.
+func LoadDiscoveryState(filename string) (*DiscoveryState, error) {
+	state := &DiscoveryState{Devices: map[MACAddr]*DiscoveredDevice{}}
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, err
+	}
+	if state.Devices == nil {
+		state.Devices = map[MACAddr]*DiscoveredDevice{}
+	}
+	return state, nil
+}
+
+func (state *DiscoveryState) Save(filename string) error {
+	contents, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
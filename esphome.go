@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ESPHomeConfig configures a source of readings published by ESPHome nodes
+// running the b_parasite platform. ESPHome publishes each sensor to its own
+// topic, so values are matched against topic patterns, in which {device}
+// identifies the b-parasite and {metric} the sensor.
+type ESPHomeConfig struct {
+	MQTT   *MQTTLinkConfig `yaml:"mqtt"`
+	Topics []string        `yaml:"topics"`
+	// Maps {metric} values to metrics, for sensors not named after them.
+	Metrics map[string]string `yaml:"metrics"`
+	// Maps {device} values to MAC addresses.
+	Devices map[string]MACAddr `yaml:"devices"`
+	// How long to wait for a device's other values once the first one arrives.
+	Settle time.Duration `yaml:"settle"`
+}
+
+// ESPHome publishes sensors to <node name>/sensor/<sensor name>/state.
+const kDefaultESPHomeTopic = "{device}/sensor/{metric}/state"
+const kDefaultESPHomeSettle = 2 * time.Second
+
+// How values are stored into a reading, for each metric.
+var kESPHomeSetters = map[string]func(data *ParasiteData, value float64){
+	"soil_moisture":   func(data *ParasiteData, value float64) { data.SoilMoisture = float32(value) },
+	"temperature":     func(data *ParasiteData, value float64) { data.TempCelcius = float32(value) },
+	"humidity":        func(data *ParasiteData, value float64) { data.Humidity = float32(value) },
+	"battery_voltage": func(data *ParasiteData, value float64) { data.BatteryVoltage = float32(value) },
+	"rssi":            func(data *ParasiteData, value float64) { data.RSSI = int(math.Round(value)) },
+}
+
+func ValidateESPHomeConfig(cfg *ESPHomeConfig) error {
+	if cfg.MQTT == nil {
+		return fmt.Errorf("missing mqtt")
+	}
+	if err := ValidateMQTTLinkConfig(cfg.MQTT, ""); err != nil {
+		return fmt.Errorf("mqtt: %s", err.Error())
+	}
+	if len(cfg.Topics) == 0 {
+		cfg.Topics = []string{kDefaultESPHomeTopic}
+	}
+	for _, topic := range cfg.Topics {
+		if strings.Count(topic, "{device}") != 1 || strings.Count(topic, "{metric}") != 1 {
+			return fmt.Errorf("topics: %s must contain {device} and {metric} exactly once", topic)
+		}
+		if strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("topics: %s must not contain wildcards", topic)
+		}
+	}
+	metrics := map[string]string{}
+	for key := range kESPHomeSetters {
+		metrics[key] = key
+	}
+	for name, key := range cfg.Metrics {
+		if _, exists := kESPHomeSetters[key]; !exists {
+			return fmt.Errorf("metrics: %s: unknown metric %q", name, key)
+		}
+		metrics[name] = key
+	}
+	cfg.Metrics = metrics
+	if len(cfg.Devices) == 0 {
+		return fmt.Errorf("missing devices")
+	}
+	devices := map[string]MACAddr{}
+	for device, macAddr := range cfg.Devices {
+		devices[device] = MACAddr(strings.ToLower(string(macAddr)))
+	}
+	cfg.Devices = devices
+	if cfg.Settle == 0 {
+		cfg.Settle = kDefaultESPHomeSettle
+	}
+	return nil
+}
+
+// espHomePattern matches topics against one of the configured patterns.
+type espHomePattern struct {
+	// The MQTT subscription covering the pattern.
+	filter string
+	regexp *regexp.Regexp
+	device int
+	metric int
+}
+
+// makeESPHomePattern compiles a topic pattern. Sensor names often combine both
+// placeholders in a single level (e.g. "{device}_{metric}"), so {metric} only
+// matches the configured metric names, and {device} matches as little as
+// possible, which keeps such levels unambiguous.
+func makeESPHomePattern(topic string, metrics map[string]string) *espHomePattern {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	// Longer names first, so e.g. "soil_moisture" wins over "moisture".
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "{device}") || strings.Contains(level, "{metric}") {
+			levels[i] = "+"
+		}
+	}
+	expr := regexp.QuoteMeta(topic)
+	expr = strings.Replace(expr, regexp.QuoteMeta("{device}"), "(?P<device>[^/]+?)", 1)
+	expr = strings.Replace(expr, regexp.QuoteMeta("{metric}"), "(?P<metric>"+strings.Join(names, "|")+")", 1)
+	compiled := regexp.MustCompile("^" + expr + "$")
+	return &espHomePattern{
+		filter: strings.Join(levels, "/"),
+		regexp: compiled,
+		device: compiled.SubexpIndex("device"),
+		metric: compiled.SubexpIndex("metric"),
+	}
+}
+
+// ESPHomeSource is the source of readings published by ESPHome nodes.
+type ESPHomeSource struct {
+	name     string
+	config   *ESPHomeConfig
+	patterns []*espHomePattern
+	client   mqtt.Client
+	sink     chan<- *ParasiteData
+	mu       sync.Mutex
+	// Readings waiting for the rest of their values, by device.
+	pending map[string]*ParasiteData
+	// The latest reading of each device, whose values are carried over to the
+	// next one until they're updated.
+	latest map[string]*ParasiteData
+	// The metrics received so far, by device. The others are missing from
+	// readings, rather than published as 0.
+	received map[string]map[string]bool
+	// Devices we've already complained about not being mapped to a MAC address.
+	unknown map[string]bool
+}
+
+func init() {
+	RegisterSource("esphome", func(cfg *SourceConfig) (DataSource, error) {
+		espHomeCfg := &ESPHomeConfig{}
+		if err := cfg.DecodeOptions(espHomeCfg); err != nil {
+			return nil, err
+		}
+		if err := ValidateESPHomeConfig(espHomeCfg); err != nil {
+			return nil, err
+		}
+		return MakeESPHomeSource(cfg.Name, espHomeCfg)
+	})
+}
+
+func MakeESPHomeSource(name string, cfg *ESPHomeConfig) (*ESPHomeSource, error) {
+	source := &ESPHomeSource{
+		name:     name,
+		config:   cfg,
+		pending:  map[string]*ParasiteData{},
+		latest:   map[string]*ParasiteData{},
+		received: map[string]map[string]bool{},
+		unknown:  map[string]bool{},
+	}
+	for _, topic := range cfg.Topics {
+		source.patterns = append(source.patterns, makeESPHomePattern(topic, cfg.Metrics))
+	}
+	filters := []string{}
+	for _, pattern := range source.patterns {
+		filters = append(filters, pattern.filter)
+	}
+	client, err := makeMQTTReceiver(cfg.MQTT, source.onMessage, filters...)
+	if err != nil {
+		return nil, err
+	}
+	source.client = client
+	return source, nil
+}
+
+func (source *ESPHomeSource) onMessage(_ mqtt.Client, msg mqtt.Message) {
+	// ESPHome retains sensor states by default, so we'd otherwise receive stale
+	// values as if they were fresh whenever we (re)subscribe.
+	if msg.Retained() {
+		return
+	}
+	for _, pattern := range source.patterns {
+		match := pattern.regexp.FindStringSubmatch(msg.Topic())
+		if match == nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+		// ESPHome publishes "nan" for sensors without a value.
+		if err != nil || math.IsNaN(value) {
+			logger.Printf("[esphome] Ignoring value %q on %s\n", msg.Payload(), msg.Topic())
+			return
+		}
+		source.record(match[pattern.device], source.config.Metrics[match[pattern.metric]], value)
+		return
+	}
+}
+
+// record stores a device's value into its pending reading, which is sent once
+// the settle period is over.
+func (source *ESPHomeSource) record(device string, metric string, value float64) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	macAddr, exists := source.config.Devices[device]
+	if !exists {
+		if !source.unknown[device] {
+			logger.Printf("[esphome] Received values from %s, but it's not mapped to a MAC address\n", device)
+			source.unknown[device] = true
+		}
+		return
+	}
+	data, exists := source.pending[device]
+	if !exists {
+		data = &ParasiteData{}
+		if latest := source.latest[device]; latest != nil {
+			*data = *latest
+		}
+		data.Key = string(macAddr)
+		data.Satellite = source.name
+		data.NoCounter = true
+		source.pending[device] = data
+		time.AfterFunc(source.config.Settle, func() { source.flush(device) })
+	}
+	data.Time = time.Now()
+	kESPHomeSetters[metric](data, value)
+	if source.received[device] == nil {
+		source.received[device] = map[string]bool{}
+	}
+	source.received[device][metric] = true
+}
+
+func (source *ESPHomeSource) flush(device string) {
+	source.mu.Lock()
+	data := source.pending[device]
+	delete(source.pending, device)
+	data.Missing = nil
+	for _, metric := range kMQTTMetrics {
+		if !source.received[device][metric.Key] {
+			data.Missing = append(data.Missing, metric.Key)
+		}
+	}
+	source.latest[device] = data
+	source.mu.Unlock()
+	source.sink <- data
+}
+
+func (source *ESPHomeSource) Run(sink chan<- *ParasiteData) {
+	source.sink = sink
+	connectWithRetry(source.client, source.config.MQTT.Host)
+	select {}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ChangeFilter implements change-only publishing. It remembers the last
+// published value of each device's metrics, and lets a metric through only
+// when it moved by at least its deadband, or when it hasn't been published
+// for a while (a heartbeat).
+type ChangeFilter struct {
+	mu        sync.Mutex
+	published map[MACAddr]map[string]*publishedValue
+}
+
+type publishedValue struct {
+	value float64
+	at    time.Time
+}
+
+func MakeChangeFilter() *ChangeFilter {
+	return &ChangeFilter{published: map[MACAddr]map[string]*publishedValue{}}
+}
+
+// Filter returns the metrics of data that should be published.
+func (filter *ChangeFilter) Filter(cfg *MQTTConfig, macAddr MACAddr, data *ParasiteData) []*MQTTMetric {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+
+	changed := []*MQTTMetric{}
+	for _, metric := range kMQTTMetrics {
+		last, exists := filter.published[macAddr][metric.Key]
+		if !exists || data.Time.Sub(last.at) >= cfg.HeartbeatInterval {
+			changed = append(changed, metric)
+			continue
+		}
+		value := cfg.RoundMetric(metric, metric.Value(data))
+		deadband := 0.
+		if metricConfig := cfg.Metrics[metric.Key]; metricConfig != nil {
+			deadband = metricConfig.Deadband
+		}
+		// Without a deadband, any change in the published value counts.
+		if (deadband == 0 && value != last.value) || (deadband > 0 && math.Abs(value-last.value) >= deadband) {
+			changed = append(changed, metric)
+		}
+	}
+	return changed
+}
+
+// Record remembers the values of metrics in data as published.
+func (filter *ChangeFilter) Record(cfg *MQTTConfig, macAddr MACAddr, data *ParasiteData, metrics []*MQTTMetric) {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+
+	if filter.published[macAddr] == nil {
+		filter.published[macAddr] = map[string]*publishedValue{}
+	}
+	for _, metric := range metrics {
+		filter.published[macAddr][metric.Key] = &publishedValue{
+			value: cfg.RoundMetric(metric, metric.Value(data)),
+			at:    data.Time,
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// GatewayConfig configures a source of raw advertisements forwarded by BLE
+// gateways, e.g. Shelly BLU gateways, OpenMQTTGateway or custom ESP scripts.
+type GatewayConfig struct {
+	MQTT *MQTTLinkConfig     `yaml:"mqtt"`
+	HTTP *HTTPEndpointConfig `yaml:"http"`
+}
+
+// Where OpenMQTTGateway publishes the advertisements it receives.
+const kDefaultGatewayTopic = "home/+/BTtoMQTT/#"
+const kDefaultGatewayPath = "/advertisements"
+
+// The UUID of b-parasite service data, in its 16 and 128-bit forms.
+const kParasiteServiceUUID = "181a"
+const kParasiteServiceUUID128 = "0000181a-0000-1000-8000-00805f9b34fb"
+
+// The local name b-parasites advertise. Other devices (e.g. thermometers running
+// the ATC or pvvx firmware) advertise service data with the same UUID.
+const kParasiteLocalName = "prst"
+
+// Gateways don't agree on field names, so each field is looked up under each
+// of these names.
+var kGatewayAddressFields = []string{"mac", "address", "addr", "id"}
+var kGatewayServiceDataFields = []string{"service_data", "servicedata", "serviceData"}
+var kGatewayServiceUUIDFields = []string{"service_data_uuid", "servicedatauuid", "serviceDataUUID"}
+var kGatewayNameFields = []string{"name", "local_name", "localName"}
+
+func ValidateGatewayConfig(cfg *GatewayConfig) error {
+	if cfg.MQTT == nil && cfg.HTTP == nil {
+		return fmt.Errorf("at least one of mqtt and http must be set")
+	}
+	if cfg.MQTT != nil {
+		if err := ValidateMQTTLinkConfig(cfg.MQTT, kDefaultGatewayTopic); err != nil {
+			return fmt.Errorf("mqtt: %s", err.Error())
+		}
+	}
+	if cfg.HTTP != nil {
+		if err := ValidateHTTPEndpointConfig(cfg.HTTP, kDefaultGatewayPath); err != nil {
+			return fmt.Errorf("http: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterSource("gateway", func(cfg *SourceConfig) (DataSource, error) {
+		gatewayCfg := &GatewayConfig{}
+		if err := cfg.DecodeOptions(gatewayCfg); err != nil {
+			return nil, err
+		}
+		if err := ValidateGatewayConfig(gatewayCfg); err != nil {
+			return nil, err
+		}
+		var filter string
+		if gatewayCfg.MQTT != nil {
+			filter = gatewayCfg.MQTT.Topic
+		}
+		ble := &cfg.root.BLE
+		return MakeMessageReceiver("gateway", gatewayCfg.MQTT, filter, gatewayCfg.HTTP, func(payload []byte) ([]*ParasiteData, error) {
+			return decodeGatewayAdvertisements(payload, ble, cfg.Name)
+		})
+	})
+}
+
+func isParasiteServiceUUID(uuid string) bool {
+	uuid = strings.TrimPrefix(strings.ToLower(uuid), "0x")
+	return uuid == kParasiteServiceUUID || uuid == kParasiteServiceUUID128
+}
+
+// lookupString returns the first of the fields that's set to a string.
+func lookupString(adv map[string]interface{}, fields []string) (string, bool) {
+	for _, field := range fields {
+		if value, ok := adv[field].(string); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// parasiteServiceData returns the hex-encoded b-parasite service data of an
+// advertisement, if it has any. Service data is either a single hex string
+// (with its UUID in a separate field, if any), or an object mapping UUIDs to
+// hex strings.
+func parasiteServiceData(adv map[string]interface{}) (string, bool) {
+	for _, field := range kGatewayServiceDataFields {
+		switch serviceData := adv[field].(type) {
+		case string:
+			if uuid, exists := lookupString(adv, kGatewayServiceUUIDFields); exists && !isParasiteServiceUUID(uuid) {
+				return "", false
+			}
+			return serviceData, true
+		case map[string]interface{}:
+			for uuid, data := range serviceData {
+				if hexData, ok := data.(string); ok && isParasiteServiceUUID(uuid) {
+					return hexData, true
+				}
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// decodeGatewayAdvertisements decodes a JSON advertisement, or an array of
+// them, as forwarded by a gateway. Advertisements without b-parasite service
+// data are skipped, since gateways usually forward everything they hear, as are
+// advertisements whose local name, if the gateway forwards it, isn't the one
+// b-parasites advertise.
+// Readings are tagged with the source's name, like readings from satellites.
+func decodeGatewayAdvertisements(payload []byte, ble *BLEConfig, source string) ([]*ParasiteData, error) {
+	var advs []map[string]interface{}
+	if strings.HasPrefix(strings.TrimSpace(string(payload)), "[") {
+		if err := json.Unmarshal(payload, &advs); err != nil {
+			return nil, err
+		}
+	} else {
+		adv := map[string]interface{}{}
+		if err := json.Unmarshal(payload, &adv); err != nil {
+			return nil, err
+		}
+		advs = append(advs, adv)
+	}
+
+	readings := []*ParasiteData{}
+	var firstErr error
+	for _, adv := range advs {
+		serviceData, isParasite := parasiteServiceData(adv)
+		if name, exists := lookupString(adv, kGatewayNameFields); exists && name != kParasiteLocalName {
+			isParasite = false
+		}
+		if !isParasite {
+			continue
+		}
+		raw := &RawAdvertisement{ServiceData: serviceData}
+		raw.Address, _ = lookupString(adv, kGatewayAddressFields)
+		if rssi, ok := adv["rssi"].(float64); ok {
+			raw.RSSI = int(rssi)
+		}
+		var err error
+		var data *ParasiteData
+		if raw.Address == "" {
+			err = fmt.Errorf("missing address")
+		} else {
+			data, err = raw.Decode(ble)
+		}
+		if err != nil {
+			stats.RecordDecodeError()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		data.Satellite = source
+		readings = append(readings, data)
+	}
+	if len(readings) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return readings, nil
+}
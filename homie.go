@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HomieConfig configures an output following the Homie 4 convention
+// (https://homieiot.github.io/), which openHAB and Node-RED can auto-discover.
+// Each device in the registry becomes a Homie device. The scanner itself is
+// a Homie device as well, whose $state tells whether the scanner is connected.
+type HomieConfig struct {
+	Host                      string                          `yaml:"host"`
+	Username                  string                          `yaml:"username"`
+	Password                  string                          `yaml:"password"`
+	ClientId                  string                          `yaml:"client_id"`
+	TLS                       *TLSConfig                      `yaml:"tls"`
+	BaseTopic                 string                          `yaml:"base_topic"`
+	DeviceID                  string                          `yaml:"device_id"`
+	DeviceAvailabilityTimeout time.Duration                   `yaml:"device_availability_timeout"`
+	Registry                  map[MACAddr]*MQTTParasiteConfig `yaml:"registry"`
+}
+
+const kHomieVersion = "4.0"
+const kDefaultHomieBaseTopic = "homie"
+const kDefaultHomieDeviceID = "parasite-scanner"
+
+// Homie 4 requires every device to list its extensions in a retained
+// $extensions attribute, but an empty retained message deletes it instead, so
+// we list our own. Under this extension, a device relayed by another one
+// publishes the latter's ID as $bridge. Its $state is only current while the
+// bridge's $state is "ready": a bridge that disconnects unexpectedly can't
+// mark the devices it relays "lost", only itself.
+const kHomieBridgeExtension = "com.github.rbaron.parasite-scanner.bridge:1.0.0:[4.x]"
+
+// Homie IDs may only contain lowercase letters, digits and hyphens, and must
+// not start or end with a hyphen.
+var kHomieIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func ValidateHomieConfig(cfg *HomieConfig) error {
+	if cfg.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if err := ValidateTLSConfig(cfg.TLS); err != nil {
+		return fmt.Errorf("tls: %s", err.Error())
+	}
+	if cfg.BaseTopic == "" {
+		cfg.BaseTopic = kDefaultHomieBaseTopic
+	}
+	if cfg.DeviceID == "" {
+		cfg.DeviceID = kDefaultHomieDeviceID
+	}
+	if !kHomieIDPattern.MatchString(cfg.DeviceID) {
+		return fmt.Errorf("invalid device_id %q: only lowercase letters, digits and hyphens are allowed", cfg.DeviceID)
+	}
+	registry, err := ValidateRegistry(cfg.Registry)
+	if err != nil {
+		return err
+	}
+	cfg.Registry = registry
+	return nil
+}
+
+// HomieProperty describes a property of a Homie node, and how its value is
+// derived from a reading.
+type HomieProperty struct {
+	// The key of the metric the property is made of, if any.
+	Metric   string
+	ID       string
+	Name     string
+	Datatype string
+	Unit     string
+	Format   string
+	Value    func(data *ParasiteData) string
+}
+
+type HomieNode struct {
+	ID         string
+	Name       string
+	Type       string
+	Properties []*HomieProperty
+}
+
+// homieMetricProperty makes a property out of one of kMQTTMetrics, so values
+// are formatted the same way as in the MQTT output.
+func homieMetricProperty(id string, key string, datatype string, format string) *HomieProperty {
+	for _, metric := range kMQTTMetrics {
+		if metric.Key == key {
+			return &HomieProperty{
+				Metric:   key,
+				ID:       id,
+				Name:     metric.Name,
+				Datatype: datatype,
+				Unit:     metric.Unit,
+				Format:   format,
+				Value: func(data *ParasiteData) string {
+					return fmt.Sprintf(metric.Format, metric.Value(data))
+				},
+			}
+		}
+	}
+	panic("unknown metric: " + key)
+}
+
+// The nodes of each b-parasite, one per sensor.
+var kHomieNodes = []*HomieNode{
+	{ID: "soil", Name: "Soil", Type: "soil-moisture-sensor", Properties: []*HomieProperty{
+		homieMetricProperty("moisture", "soil_moisture", "float", "0:100"),
+	}},
+	{ID: "air", Name: "Air", Type: "temperature-humidity-sensor", Properties: []*HomieProperty{
+		homieMetricProperty("temperature", "temperature", "float", ""),
+		homieMetricProperty("humidity", "humidity", "float", "0:100"),
+	}},
+	{ID: "battery", Name: "Battery", Type: "battery", Properties: []*HomieProperty{
+		homieMetricProperty("voltage", "battery_voltage", "float", ""),
+	}},
+	{ID: "radio", Name: "Radio", Type: "ble", Properties: []*HomieProperty{
+		homieMetricProperty("rssi", "rssi", "integer", ""),
+		{ID: "last-seen", Name: "Last Seen", Datatype: "datetime",
+			Value: func(data *ParasiteData) string { return data.Time.UTC().Format(time.RFC3339) }},
+	}},
+}
+
+// The single node of the scanner's own Homie device.
+var kHomieBridgeNode = &HomieNode{ID: "scanner", Name: "Scanner", Type: "parasite-scanner", Properties: []*HomieProperty{
+	{ID: "version", Name: "Version", Datatype: "string",
+		Value: func(_ *ParasiteData) string { return version }},
+}}
+
+// HomieClient publishes readings following the Homie 4 convention.
+type HomieClient struct {
+	client   mqtt.Client
+	outgoing chan *ParasiteData
+	config   *HomieConfig
+	devices  *DeviceTracker
+}
+
+func init() {
+	RegisterOutput("homie", func(cfg *OutputConfig) (DataSubscriber, error) {
+		homieCfg := &HomieConfig{}
+		if err := cfg.DecodeOptions(homieCfg); err != nil {
+			return nil, err
+		}
+		if len(homieCfg.Registry) == 0 {
+			homieCfg.Registry = cfg.SharedRegistry()
+		}
+		if err := ValidateHomieConfig(homieCfg); err != nil {
+			return nil, err
+		}
+		return MakeHomieClient(homieCfg)
+	})
+}
+
+func MakeHomieClient(cfg *HomieConfig) (*HomieClient, error) {
+	client := &HomieClient{
+		outgoing: make(chan *ParasiteData),
+		config:   cfg,
+		devices:  MakeDeviceTracker(cfg.DeviceAvailabilityTimeout),
+	}
+	opts, err := makeClientOptions(cfg.Host, cfg.Username, cfg.Password, cfg.ClientId, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	opts.
+		SetWill(client.deviceTopic(cfg.DeviceID, "$state"), "lost", 1, true).
+		SetOnConnectHandler(client.onConnect)
+	client.client = mqtt.NewClient(opts)
+	return client, nil
+}
+
+// homieDeviceID derives a device's Homie ID from its MAC address, so renaming
+// a device doesn't change its identity.
+func homieDeviceID(deviceConfig *MQTTParasiteConfig) string {
+	return strings.Replace(deviceConfig.DeviceID(), "_", "-", -1)
+}
+
+func (client *HomieClient) deviceTopic(deviceID string, parts ...string) string {
+	return strings.Join(append([]string{client.config.BaseTopic, deviceID}, parts...), "/")
+}
+
+func (client *HomieClient) publish(topic string, msg string) mqtt.Token {
+	return publishTracked(client.client, topic, msg, true, 1)
+}
+
+// publishDevice publishes the attributes of a Homie device and its nodes.
+// Homie requires the device's $state to be "init" while doing so. The
+// b-parasites are relayed by the scanner's device, the scanner's device isn't.
+func (client *HomieClient) publishDevice(deviceID string, name string, nodes []*HomieNode) {
+	client.publish(client.deviceTopic(deviceID, "$state"), "init")
+	client.publish(client.deviceTopic(deviceID, "$homie"), kHomieVersion)
+	client.publish(client.deviceTopic(deviceID, "$name"), name)
+	client.publish(client.deviceTopic(deviceID, "$extensions"), kHomieBridgeExtension)
+	if deviceID != client.config.DeviceID {
+		client.publish(client.deviceTopic(deviceID, "$bridge"), client.config.DeviceID)
+	}
+	nodeIDs := []string{}
+	for _, node := range nodes {
+		nodeIDs = append(nodeIDs, node.ID)
+		client.publish(client.deviceTopic(deviceID, node.ID, "$name"), node.Name)
+		client.publish(client.deviceTopic(deviceID, node.ID, "$type"), node.Type)
+		propertyIDs := []string{}
+		for _, property := range node.Properties {
+			propertyIDs = append(propertyIDs, property.ID)
+			client.publish(client.deviceTopic(deviceID, node.ID, property.ID, "$name"), property.Name)
+			client.publish(client.deviceTopic(deviceID, node.ID, property.ID, "$datatype"), property.Datatype)
+			if property.Unit != "" {
+				client.publish(client.deviceTopic(deviceID, node.ID, property.ID, "$unit"), property.Unit)
+			}
+			if property.Format != "" {
+				client.publish(client.deviceTopic(deviceID, node.ID, property.ID, "$format"), property.Format)
+			}
+		}
+		client.publish(client.deviceTopic(deviceID, node.ID, "$properties"), strings.Join(propertyIDs, ","))
+	}
+	client.publish(client.deviceTopic(deviceID, "$nodes"), strings.Join(nodeIDs, ","))
+}
+
+func (client *HomieClient) publishValues(deviceID string, nodes []*HomieNode, data *ParasiteData) {
+	for _, node := range nodes {
+		for _, property := range node.Properties {
+			if property.Metric != "" && !data.HasMetric(property.Metric) {
+				continue
+			}
+			client.publish(client.deviceTopic(deviceID, node.ID, property.ID), property.Value(data))
+		}
+	}
+}
+
+// publishState publishes a b-parasite's lifecycle state. Devices we haven't
+// heard from within the availability timeout are reported "lost".
+func (client *HomieClient) publishState(deviceConfig *MQTTParasiteConfig, online bool) {
+	state := "ready"
+	if !online {
+		state = "lost"
+	}
+	client.publish(client.deviceTopic(homieDeviceID(deviceConfig), "$state"), state)
+}
+
+func (client *HomieClient) isOnline(macAddr MACAddr) bool {
+	return client.config.DeviceAvailabilityTimeout == 0 || client.devices.IsOnline(macAddr)
+}
+
+// onConnect is called by paho on the initial connection and after every
+// reconnection. Retained messages may have been lost in the meantime, so every
+// device is published again.
+func (client *HomieClient) onConnect(_ mqtt.Client) {
+	logger.Printf("[homie] Connected to %s\n", client.config.Host)
+	bridgeNodes := []*HomieNode{kHomieBridgeNode}
+	client.publishDevice(client.config.DeviceID, client.config.DeviceID, bridgeNodes)
+	client.publishValues(client.config.DeviceID, bridgeNodes, nil)
+	for macAddr, deviceConfig := range client.config.Registry {
+		deviceID := homieDeviceID(deviceConfig)
+		client.publishDevice(deviceID, deviceConfig.Name, kHomieNodes)
+		if data := client.devices.Latest(macAddr); data != nil {
+			client.publishValues(deviceID, kHomieNodes, data)
+		}
+		client.publishState(deviceConfig, client.isOnline(macAddr))
+	}
+	client.publish(client.deviceTopic(client.config.DeviceID, "$state"), "ready")
+	if elector != nil {
+		client.client.Subscribe(client.deviceTopic(client.config.DeviceID, "$state"), 1, client.onBridgeState)
+	}
+}
+
+// With leader election, the previous leader's will may mark the scanner lost
+// after we took over. We're still there, so we say so again.
+func (client *HomieClient) onBridgeState(_ mqtt.Client, msg mqtt.Message) {
+	if string(msg.Payload()) == "lost" && isLeader() {
+		logger.Printf("[homie] %s was marked lost, most likely by the previous leader's will\n", msg.Topic())
+		client.publish(msg.Topic(), "ready")
+	}
+}
+
+// expireDevices periodically marks silent devices as lost.
+func (client *HomieClient) expireDevices() {
+	client.devices.ExpireEvery(func(macAddr MACAddr) {
+		logger.Printf("[homie] Haven't heard from %s in %s, marking it lost\n", macAddr, client.config.DeviceAvailabilityTimeout)
+		if deviceConfig, exists := client.config.Registry[macAddr]; exists {
+			client.publishState(deviceConfig, false)
+		}
+	})
+}
+
+func (client *HomieClient) Ingest(data *ParasiteData) {
+	client.outgoing <- data
+}
+
+func (client *HomieClient) Run() {
+	go connectWhileLeader(client.client, client.config.Host)
+	if client.config.DeviceAvailabilityTimeout > 0 {
+		go client.expireDevices()
+	}
+
+	for data := range client.outgoing {
+		deviceConfig, exists := client.config.Registry[MACAddr(data.Key)]
+		if !exists {
+			logger.Printf("Received valid BLE broadcast from %s, but it's not configured for Homie\n", data.Key)
+			continue
+		}
+		cameOnline := client.devices.Seen(deviceConfig.MAC, data)
+		if !client.client.IsConnectionOpen() {
+			// The latest reading is published once we're (re)connected.
+			continue
+		}
+		client.publishValues(homieDeviceID(deviceConfig), kHomieNodes, data)
+		if cameOnline && client.config.DeviceAvailabilityTimeout > 0 {
+			client.publishState(deviceConfig, true)
+		}
+	}
+}
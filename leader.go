@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// LeaderConfig configures the election of a leader among redundant scanners
+// receiving the same devices. Only the leader publishes to MQTT and Homie
+// outputs. The others stand by, and take over once the leader's heartbeat has
+// been missing for Timeout.
+type LeaderConfig struct {
+	// Identifies this instance in the lock. Defaults to the hostname, which
+	// isn't necessarily unique (e.g. every Raspberry Pi OS install is called
+	// "raspberrypi"), so the lock also carries a per-process nonce.
+	ID string `yaml:"id"`
+	// The broker holding the lock, which must be shared by all instances. The
+	// lock is a retained message on its topic.
+	MQTT      *MQTTLinkConfig `yaml:"mqtt"`
+	Heartbeat time.Duration   `yaml:"heartbeat"`
+	Timeout   time.Duration   `yaml:"timeout"`
+}
+
+const kDefaultLeaderTopic = "parasite-scanner/leader"
+const kDefaultLeaderHeartbeat = 5 * time.Second
+const kDefaultLeaderTimeout = 30 * time.Second
+
+// How long paho waits for in-flight messages when a standby disconnects.
+const kDisconnectQuiesce = 250
+
+func ValidateLeaderConfig(cfg *LeaderConfig) error {
+	if cfg.ID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("missing id")
+		}
+		cfg.ID = hostname
+	}
+	if cfg.MQTT == nil {
+		return fmt.Errorf("missing mqtt")
+	}
+	if err := ValidateMQTTLinkConfig(cfg.MQTT, kDefaultLeaderTopic); err != nil {
+		return fmt.Errorf("mqtt: %s", err.Error())
+	}
+	if strings.ContainsAny(cfg.MQTT.Topic, "+#") {
+		return fmt.Errorf("mqtt: topic must not contain wildcards")
+	}
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = kDefaultLeaderHeartbeat
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = kDefaultLeaderTimeout
+	}
+	if cfg.Heartbeat < 0 || cfg.Timeout < 3*cfg.Heartbeat {
+		return fmt.Errorf("timeout must be at least three times the heartbeat")
+	}
+	return nil
+}
+
+// LeaderLock is the retained message on the lock topic, which the leader
+// republishes on every heartbeat.
+type LeaderLock struct {
+	ID string `json:"id"`
+	// Random, and different for every process. Tells instances sharing an ID
+	// apart, so they don't both take the lock for their own.
+	Nonce string    `json:"nonce"`
+	Time  time.Time `json:"time"`
+}
+
+// LeaderElector takes part in the election. The lock is held by whoever
+// published it last: every instance sees the messages on the lock topic in the
+// same order, so when two instances claim it at once, they agree on the winner.
+// Heartbeats are timed by when they're received rather than by their Time, so
+// the instances' clocks don't need to agree.
+type LeaderElector struct {
+	config *LeaderConfig
+	nonce  string
+	client mqtt.Client
+	mu     sync.Mutex
+	// The lock as last received, without its Time.
+	holder LeaderLock
+	// When we last received a heartbeat from the holder.
+	lastHeartbeat time.Time
+	// When the lock became ours, as far as we know.
+	heldSince time.Time
+	leader    bool
+	listeners []chan bool
+}
+
+// The elector, if leader election is configured. Set by MakeLeaderElector.
+var elector *LeaderElector
+
+func MakeLeaderElector(cfg *LeaderConfig) (*LeaderElector, error) {
+	e := &LeaderElector{config: cfg, nonce: fmt.Sprintf("%016x", rand.Uint64())}
+	client, err := makeMQTTReceiver(cfg.MQTT, e.onLock, cfg.MQTT.Topic)
+	if err != nil {
+		return nil, err
+	}
+	e.client = client
+	elector = e
+	return e, nil
+}
+
+// isLeader reports whether this instance should publish. Without leader
+// election, it always should.
+func isLeader() bool {
+	return elector == nil || elector.IsLeader()
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Subscribe returns a channel receiving our leadership status whenever it
+// changes, starting with the current one. Only the latest status is kept, so
+// slow listeners never block the election.
+func (e *LeaderElector) Subscribe() <-chan bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan bool, 1)
+	ch <- e.leader
+	e.listeners = append(e.listeners, ch)
+	return ch
+}
+
+func (e *LeaderElector) onLock(_ mqtt.Client, msg mqtt.Message) {
+	lock := &LeaderLock{}
+	// An empty message clears the lock.
+	if len(msg.Payload()) > 0 {
+		if err := json.Unmarshal(msg.Payload(), lock); err != nil {
+			logger.Printf("[leader] Ignoring invalid lock on %s: %s\n", msg.Topic(), err.Error())
+			return
+		}
+	}
+	lock.Time = time.Time{}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if *lock != e.holder {
+		logger.Printf("[leader] The lock is now held by %q\n", lock.ID)
+		if lock.ID == e.config.ID && lock.Nonce != e.nonce {
+			logger.Printf("[leader] Another instance also goes by %q. Give each instance a unique id\n", lock.ID)
+		}
+	}
+	wasHeld := e.holds()
+	e.holder = *lock
+	e.lastHeartbeat = time.Now()
+	if e.holds() && !wasHeld {
+		e.heldSince = e.lastHeartbeat
+	}
+	e.update()
+}
+
+// holds reports whether we hold the lock. Must be called with e.mu held.
+func (e *LeaderElector) holds() bool {
+	return e.holder.ID == e.config.ID && e.holder.Nonce == e.nonce
+}
+
+// update derives our leadership from the lock, and notifies listeners of
+// changes. We lead while we hold the lock and our own heartbeats make it
+// through. A leader cut off from the broker steps down a heartbeat before the
+// others may take over, so there's never more than one leader. Likewise, a
+// claim only makes us lead once it's gone undisputed for half a heartbeat:
+// claims made at once reach each instance at slightly different times, and
+// until the last one arrives, each claimant holds the lock as far as it knows.
+// Must be called with e.mu held.
+func (e *LeaderElector) update() {
+	leader := e.holds() &&
+		time.Since(e.heldSince) >= e.config.Heartbeat/2 &&
+		time.Since(e.lastHeartbeat) < e.config.Timeout-e.config.Heartbeat
+	if leader == e.leader {
+		return
+	}
+	e.leader = leader
+	if leader {
+		logger.Printf("[leader] %s is now the leader\n", e.config.ID)
+	} else {
+		logger.Printf("[leader] %s is now on standby\n", e.config.ID)
+	}
+	for _, ch := range e.listeners {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- leader
+	}
+}
+
+// claimable reports whether we may publish the lock: either we hold it, or its
+// holder's heartbeat has been missing for too long.
+func (e *LeaderElector) claimable() (holder string, held bool, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.update()
+	return e.holder.ID, e.holds(), e.holds() || time.Since(e.lastHeartbeat) >= e.config.Timeout
+}
+
+// tick heartbeats if we hold the lock, and claims it if its holder's
+// heartbeat has been missing for too long.
+func (e *LeaderElector) tick() {
+	holder, held, ok := e.claimable()
+	if !ok || !e.client.IsConnectionOpen() {
+		return
+	}
+	if !held {
+		// Instances started together would otherwise keep claiming the lock
+		// at the same time, each overwriting the other's claim. After a random
+		// delay, whoever claimed it first has most likely been heard from.
+		time.Sleep(time.Duration(rand.Int63n(int64(e.config.Heartbeat/2) + 1)))
+		if holder, held, ok = e.claimable(); !ok {
+			return
+		}
+		if holder == "" {
+			logger.Printf("[leader] Nobody holds the lock, claiming it\n")
+		} else if !held {
+			logger.Printf("[leader] Haven't heard from %q in %s, claiming the lock\n", holder, e.config.Timeout)
+		}
+	}
+	payload, err := json.Marshal(&LeaderLock{ID: e.config.ID, Nonce: e.nonce, Time: time.Now()})
+	if err != nil {
+		logger.Printf("[leader] Unable to encode the lock: %s\n", err.Error())
+		return
+	}
+	e.client.Publish(e.config.MQTT.Topic, 1, true, payload)
+}
+
+func (e *LeaderElector) Run() {
+	connectWithRetry(e.client, e.config.MQTT.Host)
+	// The first tick comes a heartbeat after connecting, by which time the
+	// retained lock, if any, has been received.
+	for range time.Tick(e.config.Heartbeat) {
+		e.tick()
+	}
+}
+
+// connectWhileLeader keeps an output's client connected while we're the
+// leader, and disconnected while we're on standby, so the standby's will
+// doesn't mark anything offline. Without leader election, it simply connects.
+func connectWhileLeader(client mqtt.Client, host string) {
+	if elector == nil {
+		connectWithRetry(client, host)
+		return
+	}
+	for leader := range elector.Subscribe() {
+		if leader {
+			connectWithRetryWhile(client, host, isLeader)
+		} else if client.IsConnected() {
+			client.Disconnect(kDisconnectQuiesce)
+		}
+	}
+}
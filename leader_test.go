@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const kTestHeartbeat = 50 * time.Millisecond
+const kTestTimeout = 300 * time.Millisecond
+
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (msg *testMessage) Duplicate() bool   { return false }
+func (msg *testMessage) Qos() byte         { return 1 }
+func (msg *testMessage) Retained() bool    { return false }
+func (msg *testMessage) Topic() string     { return msg.topic }
+func (msg *testMessage) MessageID() uint16 { return 0 }
+func (msg *testMessage) Payload() []byte   { return msg.payload }
+func (msg *testMessage) Ack()              {}
+
+// testLockTopic returns a lock topic for the test. Runs of the same test
+// mustn't see each other's retained lock.
+func testLockTopic(t *testing.T) string {
+	return fmt.Sprintf("test/%s/%d", t.Name(), time.Now().UnixNano())
+}
+
+func makeTestElector(t *testing.T, topic string, id string) *LeaderElector {
+	cfg := &LeaderConfig{
+		ID: id,
+		MQTT: &MQTTLinkConfig{
+			Host:     kEmbeddedBrokerHost,
+			Username: "scanner",
+			Password: "secret",
+			Topic:    topic,
+		},
+		Heartbeat: kTestHeartbeat,
+		Timeout:   kTestTimeout,
+	}
+	if err := ValidateLeaderConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	e, err := MakeLeaderElector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Run never returns, but a disconnected elector no longer publishes.
+	t.Cleanup(func() { e.client.Disconnect(0) })
+	return e
+}
+
+func sendTestLock(t *testing.T, e *LeaderElector, id string, nonce string) {
+	payload, err := json.Marshal(&LeaderLock{ID: id, Nonce: nonce, Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.onLock(nil, &testMessage{topic: e.config.MQTT.Topic, payload: payload})
+}
+
+func TestLeaderElectorFollowsTheLock(t *testing.T) {
+	startTestBroker(t)
+	e := makeTestElector(t, testLockTopic(t), "scanner-a")
+
+	if _, _, ok := e.claimable(); !ok {
+		t.Error("the lock isn't claimable before anyone held it")
+	}
+
+	// Whoever published the lock last holds it, so of two claims made at
+	// once, the second wins. Until it's been received, ours mustn't make us
+	// lead.
+	sendTestLock(t, e, "scanner-a", e.nonce)
+	if e.IsLeader() {
+		t.Error("leading as soon as our claim was received")
+	}
+	sendTestLock(t, e, "scanner-b", "other")
+	if e.IsLeader() {
+		t.Error("still leading after another instance's claim was received")
+	}
+	if holder, held, ok := e.claimable(); holder != "scanner-b" || held || ok {
+		t.Errorf("claimable() = %q, %v, %v while scanner-b heartbeats", holder, held, ok)
+	}
+
+	// An instance with the same ID, but another nonce, doesn't hold our lock.
+	sendTestLock(t, e, "scanner-a", "other")
+	if e.IsLeader() {
+		t.Error("leading after another instance with our ID claimed the lock")
+	}
+
+	// Our claim makes us lead once it's gone undisputed for half a heartbeat.
+	sendTestLock(t, e, "scanner-a", e.nonce)
+	time.Sleep(kTestHeartbeat / 2)
+	sendTestLock(t, e, "scanner-a", e.nonce)
+	if !e.IsLeader() {
+		t.Error("not leading after our claim went undisputed")
+	}
+
+	// Without heartbeats, the leader steps down a heartbeat before the others
+	// may take over.
+	e.mu.Lock()
+	e.lastHeartbeat = time.Now().Add(-(kTestTimeout - kTestHeartbeat))
+	e.update()
+	e.mu.Unlock()
+	if e.IsLeader() {
+		t.Error("still leading after missing heartbeats")
+	}
+	if _, held, ok := e.claimable(); !held || !ok {
+		t.Error("the lock we hold isn't claimable")
+	}
+	e.mu.Lock()
+	e.holder = LeaderLock{ID: "scanner-b", Nonce: "other"}
+	e.mu.Unlock()
+	if _, _, ok := e.claimable(); ok {
+		t.Error("another instance's lock is claimable before the timeout")
+	}
+	e.mu.Lock()
+	e.lastHeartbeat = time.Now().Add(-kTestTimeout)
+	e.mu.Unlock()
+	if _, _, ok := e.claimable(); !ok {
+		t.Error("another instance's lock isn't claimable after the timeout")
+	}
+}
+
+// watchLeaders polls the electors for d, failing the test if more than one
+// leads at once, and returns the last one seen leading.
+func watchLeaders(t *testing.T, electors []*LeaderElector, d time.Duration) *LeaderElector {
+	var leader *LeaderElector
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		leaders := 0
+		for _, e := range electors {
+			if e.IsLeader() {
+				leaders++
+				leader = e
+			}
+		}
+		if leaders > 1 {
+			t.Fatalf("%d instances lead at once", leaders)
+		}
+	}
+	return leader
+}
+
+func TestLeaderElection(t *testing.T) {
+	startTestBroker(t)
+	// Two of them share an ID, like hosts that all kept the default hostname.
+	topic := testLockTopic(t)
+	electors := []*LeaderElector{
+		makeTestElector(t, topic, "raspberrypi"),
+		makeTestElector(t, topic, "raspberrypi"),
+		makeTestElector(t, topic, "scanner-c"),
+	}
+	// Started together, so they all claim the lock at once.
+	for _, e := range electors {
+		go e.Run()
+	}
+
+	leader := watchLeaders(t, electors, 4*kTestTimeout)
+	if leader == nil {
+		t.Fatal("nobody leads")
+	}
+
+	// Once cut off from the broker, the leader steps down, and one of the
+	// others takes over, without them ever leading at once.
+	leader.client.Disconnect(0)
+	if successor := watchLeaders(t, electors, 4*kTestTimeout); successor == nil || successor == leader {
+		t.Error("nobody took over from the disconnected leader")
+	}
+}
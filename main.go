@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"math/rand"
+	"time"
 )
 
 var showUI = flag.Bool("ui", false, "renders a terminal-based ui for iteractive use")
@@ -9,34 +11,77 @@ var configFile = flag.String("config", "config.yaml", "YAML config filename")
 
 func main() {
 	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
 
 	config, err := ParseConfig(*configFile)
 	if err != nil {
 		panic("unable to parse config file: " + err.Error())
 	}
 
-	err = InitLogger(*showUI)
+	err = InitLogger(*showUI || config.HasOutput("tui"))
 	if err != nil {
 		panic("unable to initialize logger: " + err.Error())
 	}
 	defer DeInitLogger()
 
-	dataSubscribers := []DataSubscriber{}
-	if *showUI {
+	// The broker must be listening before MQTT outputs connecting to it are made.
+	if config.Broker != nil {
+		broker, err := MakeBroker(config.Broker)
+		if err != nil {
+			panic("unable to start mqtt broker: " + err.Error())
+		}
+		go broker.Run()
+	}
+
+	// Outputs follow the election, so the elector must exist before they do.
+	if config.Leader != nil {
+		leaderElector, err := MakeLeaderElector(config.Leader)
+		if err != nil {
+			panic("unable to initialize leader election: " + err.Error())
+		}
+		go leaderElector.Run()
+	}
+
+	dataSubscribers, err := MakeOutputs(config.Outputs)
+	if err != nil {
+		panic("unable to initialize outputs: " + err.Error())
+	}
+	// The -ui switch and the top-level `mqtt` section predate the `outputs` list
+	// and are kept as shorthands for their respective outputs.
+	if *showUI && !config.HasOutput("tui") {
 		dataSubscribers = append(dataSubscribers, InitUI())
 	}
 	if config.MQTT.Host != "" {
-		dataSubscribers = append(dataSubscribers, MakeMQTTClient(&config.MQTT))
+		mqttClient, err := MakeMQTTClient(&config.MQTT)
+		if err != nil {
+			panic("unable to initialize mqtt client: " + err.Error())
+		}
+		mqttClient.reloadConfig = func() (*MQTTConfig, error) {
+			config, err := ParseConfig(*configFile)
+			if err != nil {
+				return nil, err
+			}
+			return &config.MQTT, nil
+		}
+		dataSubscribers = append(dataSubscribers, mqttClient)
 	}
 
-	scanner := MakeParasiteScanner(&config.BLE)
-	go scanner.Run()
+	sources, err := MakeSources(config.Sources)
+	if err != nil {
+		panic("unable to initialize sources: " + err.Error())
+	}
+	readings := make(chan *ParasiteData)
+	for _, source := range sources {
+		go source.Run(readings)
+	}
+	dedup := MakeDeduplicator(config.DedupWindow)
+	go dedup.Run(readings)
 
 	for _, subs := range dataSubscribers {
 		go subs.Run()
 	}
 
-	for data := range scanner.channel {
+	for data := range dedup.out {
 		logger.Println("[main] Got data:", data)
 		for _, subs := range dataSubscribers {
 			subs.Ingest(data)
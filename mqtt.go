@@ -1,8 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -13,149 +22,642 @@ type MQTTClient struct {
 	client   mqtt.Client
 	outgoing chan *ParasiteData
 	config   *MQTTConfig
+	// Holds readings while the broker is unreachable. Nil if the offline buffer
+	// is not configured.
+	queue          *DiskQueue
+	replayRequests chan struct{}
+	devices        *DeviceTracker
+	changes        *ChangeFilter
+	// Serializes (re)publishing discovery messages, which happens both on
+	// (re)connection and when Home Assistant comes online.
+	discoveryMu sync.Mutex
+	// Guards the registry and paused devices, which may change at runtime.
+	registryMu sync.RWMutex
+	paused     map[MACAddr]bool
+	// Re-reads this client's config from the config file. Used by the "reload"
+	// command.
+	reloadConfig func() (*MQTTConfig, error)
 }
 
-func MakeMQTTClient(cfg *MQTTConfig) *MQTTClient {
+func init() {
+	RegisterOutput("mqtt", func(cfg *OutputConfig) (DataSubscriber, error) {
+		mqttCfg, err := decodeMQTTConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		client, err := MakeMQTTClient(mqttCfg)
+		if err != nil {
+			return nil, err
+		}
+		client.reloadConfig = func() (*MQTTConfig, error) {
+			reloaded, err := ReloadOutputConfig(cfg.Name)
+			if err != nil {
+				return nil, err
+			}
+			return decodeMQTTConfig(reloaded)
+		}
+		return client, nil
+	})
+}
+
+// decodeMQTTConfig decodes an MQTT output's options. Outputs without a
+// registry of their own use the entries of the top-level registry routed to
+// them. The output's name goes into the default state file, so outputs sharing
+// a base topic don't share it.
+func decodeMQTTConfig(cfg *OutputConfig) (*MQTTConfig, error) {
+	mqttCfg := &MQTTConfig{}
+	if err := cfg.DecodeOptions(mqttCfg); err != nil {
+		return nil, err
+	}
+	if mqttCfg.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	if len(mqttCfg.Registry) == 0 {
+		mqttCfg.Registry = cfg.SharedRegistry()
+	}
+	defaultStateFile := mqttCfg.StateFile == ""
+	if err := ValidateMQTTConfig(mqttCfg); err != nil {
+		return nil, err
+	}
+	if defaultStateFile {
+		mqttCfg.StateFile = mqttCfg.DiscoveryNodeID() + "-" + cfg.Name + "-discovery.json"
+	}
+	return mqttCfg, nil
+}
+
+// Broker URL schemes that paho will dial over TLS.
+var kTLSSchemes = map[string]bool{"ssl": true, "tls": true, "mqtts": true, "wss": true}
+
+func makeTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Bounds for the exponential backoff between attempts at the initial connection.
+// Once connected, paho's auto-reconnect takes over, backing off up to
+// kMaxConnectRetryInterval as well.
+const kMinConnectRetryInterval = 1 * time.Second
+const kMaxConnectRetryInterval = 2 * time.Minute
+
+// How long to wait for the broker to acknowledge a published reading.
+const kPublishTimeout = 10 * time.Second
+
+// Upper bound for the random delay before republishing after Home Assistant
+// comes online.
+const kMaxHABirthDelay = 5 * time.Second
+
+// makeLinkClientOptions is makeClientOptions for the brokers sources, satellites
+// and the leader election connect to.
+func makeLinkClientOptions(cfg *MQTTLinkConfig) (*mqtt.ClientOptions, error) {
+	return makeClientOptions(cfg.Host, cfg.Username, cfg.Password, cfg.ClientId, cfg.TLS)
+}
+
+// makeClientOptions returns the paho options shared by all outputs speaking
+// MQTT: the broker URL, credentials, TLS and automatic reconnection. Callers set
+// their own will and connection handler on top.
+func makeClientOptions(host, username, password, clientID string, tlsCfg *TLSConfig) (*mqtt.ClientOptions, error) {
+	brokerHost := host
+	if host == kEmbeddedBrokerHost {
+		if embeddedBrokerURL == "" {
+			return nil, fmt.Errorf("host is %q, but the embedded broker isn't enabled", kEmbeddedBrokerHost)
+		}
+		brokerHost = embeddedBrokerURL
+	}
+	if !strings.Contains(brokerHost, "://") {
+		brokerHost = "tcp://" + brokerHost
+	}
+	brokerURL, err := url.Parse(brokerHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %s: %s", host, err.Error())
+	}
+
 	opts := mqtt.
 		NewClientOptions().
-		AddBroker(cfg.Host).
-		SetUsername(cfg.Username).
-		SetPassword(cfg.Password).
-		SetClientID(cfg.ClientId).
-		SetWill("parasite-scanner/status", "offline", 1, false)
+		AddBroker(brokerHost).
+		SetUsername(username).
+		SetPassword(password).
+		SetClientID(clientID).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(kMaxConnectRetryInterval).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Printf("[mqtt] Lost connection to %s: %s\n", host, err.Error())
+		}).
+		SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+			logger.Printf("[mqtt] Reconnecting to %s\n", host)
+		})
+
+	if tlsCfg != nil {
+		if !kTLSSchemes[brokerURL.Scheme] {
+			logger.Printf("[mqtt] TLS is configured, but %s is not a TLS broker URL (use ssl://, mqtts:// or wss://)\n", host)
+		}
+		tlsConfig, err := makeTLSConfig(tlsCfg)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err.Error())
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
 
 	// opts.SetKeepAlive(1 * time.Second)
 	// opts.SetPingTimeout(1 * time.Second)
 
-	client := mqtt.NewClient(opts)
-	return &MQTTClient{
-		client:   client,
-		outgoing: make(chan *ParasiteData),
-		config:   cfg,
-	}
-}
-
-type AutoDiscoveryDeviceInfo struct {
-	Identifiers  string `json:"identifiers"`
-	Name         string `json:"name"`
-	Manufacturer string `json:"manufacturer"`
-}
-
-type AutoDiscoveryPayload struct {
-	DeviceClass       string                   `json:"device_class"`
-	UnitOfMeasument   string                   `json:"unit_of_measurement"`
-	Name              string                   `json:"name"`
-	StateTopic        string                   `json:"state_topic"`
-	AvailabilityTopic string                   `json:"availability_topic"`
-	UniqueID          string                   `json:"unique_id"`
-	Device            *AutoDiscoveryDeviceInfo `json:"device"`
-}
-
-type AutoDiscoveryMsg struct {
-	Topic   string
-	Payload AutoDiscoveryPayload
-}
-
-func makeAutoDiscoveryMessages(deviceConfig *MQTTParasiteConfig) []*AutoDiscoveryMsg {
-	device := &AutoDiscoveryDeviceInfo{
-		Identifiers:  "parasite-scanner",
-		Name:         "parasite-scanner",
-		Manufacturer: "rbaron",
-	}
-	return []*AutoDiscoveryMsg{
-		{Topic: fmt.Sprintf("homeassistant/sensor/parasite-scanner/%s_soil_moisture/config", deviceConfig.NormalizedName()),
-			Payload: AutoDiscoveryPayload{
-				DeviceClass:       "humidity",
-				UnitOfMeasument:   "%",
-				Name:              fmt.Sprintf("%s Soil Moisture", deviceConfig.Name),
-				StateTopic:        deviceConfig.SoilMoistureTopic(),
-				UniqueID:          fmt.Sprintf("%s_soil_moisture", deviceConfig.NormalizedName()),
-				AvailabilityTopic: "parasite-scanner/status",
-				Device:            device,
-			}},
-		{Topic: fmt.Sprintf("homeassistant/sensor/parasite-scanner/%s_temperature/config", deviceConfig.NormalizedName()),
-			Payload: AutoDiscoveryPayload{
-				DeviceClass:       "temperature",
-				UnitOfMeasument:   "°C",
-				Name:              fmt.Sprintf("%s Temperature", deviceConfig.Name),
-				StateTopic:        deviceConfig.TemperatureTopic(),
-				UniqueID:          fmt.Sprintf("%s_temperature", deviceConfig.NormalizedName()),
-				AvailabilityTopic: "parasite-scanner/status",
-				Device:            device,
-			}},
-		{Topic: fmt.Sprintf("homeassistant/sensor/parasite-scanner/%s_humidity/config", deviceConfig.NormalizedName()),
-			Payload: AutoDiscoveryPayload{
-				DeviceClass:       "humidity",
-				UnitOfMeasument:   "%",
-				Name:              fmt.Sprintf("%s Humidity", deviceConfig.Name),
-				StateTopic:        deviceConfig.HumidityTopic(),
-				UniqueID:          fmt.Sprintf("%s_humidity", deviceConfig.NormalizedName()),
-				AvailabilityTopic: "parasite-scanner/status",
-				Device:            device,
-			}},
-		{Topic: fmt.Sprintf("homeassistant/sensor/parasite-scanner/%s_battery_voltage/config", deviceConfig.NormalizedName()),
-			Payload: AutoDiscoveryPayload{
-				DeviceClass:       "voltage",
-				UnitOfMeasument:   "V",
-				Name:              fmt.Sprintf("%s Battery Voltage", deviceConfig.Name),
-				StateTopic:        deviceConfig.BatteryVoltageTopic(),
-				UniqueID:          fmt.Sprintf("%s_battery_voltage", deviceConfig.NormalizedName()),
-				AvailabilityTopic: "parasite-scanner/status",
-				Device:            device,
-			}},
-		{Topic: fmt.Sprintf("homeassistant/sensor/parasite-scanner/%s_rssi/config", deviceConfig.NormalizedName()),
-			Payload: AutoDiscoveryPayload{
-				DeviceClass:       "signal_strength",
-				UnitOfMeasument:   "dB",
-				Name:              fmt.Sprintf("%s RSSI", deviceConfig.Name),
-				StateTopic:        deviceConfig.RSSITopic(),
-				UniqueID:          fmt.Sprintf("%s_rssi", deviceConfig.NormalizedName()),
-				AvailabilityTopic: "parasite-scanner/status",
-				Device:            device,
-			}},
-	}
-}
-
-func (client *MQTTClient) publishData(deviceConfig *MQTTParasiteConfig, data *ParasiteData) {
-	client.Publish(deviceConfig.SoilMoistureTopic(), fmt.Sprintf("%.1f", data.SoilMoisture), false, 1)
-	client.Publish(deviceConfig.TemperatureTopic(), fmt.Sprintf("%.1f", data.TempCelcius), false, 1)
-	client.Publish(deviceConfig.HumidityTopic(), fmt.Sprintf("%.1f", data.Humidity), false, 1)
-	client.Publish(deviceConfig.BatteryVoltageTopic(), fmt.Sprintf("%.1f", data.BatteryVoltage), false, 1)
-	client.Publish(deviceConfig.RSSITopic(), fmt.Sprintf("%d", data.RSSI), false, 1)
+	return opts, nil
 }
 
-func (client *MQTTClient) Publish(topic string, msg string, retained bool, qos byte) mqtt.Token {
+// connectWithRetry keeps trying to establish the initial connection to the
+// broker, backing off exponentially between attempts.
+func connectWithRetry(client mqtt.Client, host string) {
+	connectWithRetryWhile(client, host, func() bool { return true })
+}
+
+// connectWithRetryWhile is connectWithRetry, giving up once proceed returns
+// false.
+func connectWithRetryWhile(client mqtt.Client, host string, proceed func() bool) {
+	retryInterval := kMinConnectRetryInterval
+	for proceed() {
+		token := client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		logger.Printf("[mqtt] Unable to connect to %s: %s. Retrying in %s\n", host, token.Error().Error(), retryInterval)
+		time.Sleep(retryInterval)
+		retryInterval *= 2
+		if retryInterval > kMaxConnectRetryInterval {
+			retryInterval = kMaxConnectRetryInterval
+		}
+	}
+}
+
+// publishTracked publishes a message, and records its outcome in the stats in
+// the background.
+func publishTracked(client mqtt.Client, topic string, msg string, retained bool, qos byte) mqtt.Token {
 	logger.Printf("[mqtt] Publishing %s to %s\n", msg, topic)
-	return client.client.Publish(topic, qos, retained, msg)
+	start := time.Now()
+	token := client.Publish(topic, qos, retained, msg)
+	go trackPublish(topic, start, token)
+	return token
+}
+
+// trackPublish waits for the outcome of a publish, logs failures and records
+// it in the stats.
+func trackPublish(topic string, start time.Time, token mqtt.Token) {
+	var err error
+	if !token.WaitTimeout(kPublishTimeout) {
+		err = fmt.Errorf("timed out after %s", kPublishTimeout)
+	} else {
+		err = token.Error()
+	}
+	if err != nil {
+		logger.Printf("[mqtt] Publishing to %s failed: %s\n", topic, err.Error())
+	}
+	stats.RecordPublish(topic, time.Since(start), err)
+}
+
+func MakeMQTTClient(cfg *MQTTConfig) (*MQTTClient, error) {
+	client := &MQTTClient{
+		outgoing:       make(chan *ParasiteData),
+		config:         cfg,
+		replayRequests: make(chan struct{}, 1),
+		devices:        MakeDeviceTracker(cfg.DeviceAvailabilityTimeout),
+		paused:         map[MACAddr]bool{},
+		changes:        MakeChangeFilter(),
+	}
+
+	if cfg.OfflineBuffer != nil {
+		queue, err := MakeDiskQueue(cfg.OfflineBuffer.Path, cfg.OfflineBuffer.MaxSize, cfg.OfflineBuffer.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("offline_buffer: %s", err.Error())
+		}
+		client.queue = queue
+		stats.RegisterQueue(cfg.Host+" offline buffer", queue.Len)
+	}
+
+	opts, err := makeClientOptions(cfg.Host, cfg.Username, cfg.Password, cfg.ClientId, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	opts.
+		SetWill(cfg.AvailabilityTopic(), "offline", 1, false).
+		SetOnConnectHandler(client.onConnect)
+
+	client.client = mqtt.NewClient(opts)
+	return client, nil
+}
+
+// MQTTMetric describes how one of ParasiteData's values is published and
+// presented to Home Assistant.
+type MQTTMetric struct {
+	Key         string
+	Name        string
+	DeviceClass string
+	Unit        string
+	Format      string
+	// Diagnostic metrics describe the device itself rather than the plant.
+	Diagnostic bool
+	Value      func(data *ParasiteData) float64
+	Summary    func(stats *AggregateStats) MetricSummary
+}
+
+var kMQTTMetrics = []*MQTTMetric{
+	{Key: "soil_moisture", Name: "Soil Moisture", DeviceClass: "humidity", Unit: "%", Format: "%.1f",
+		Value:   func(data *ParasiteData) float64 { return float64(data.SoilMoisture) },
+		Summary: func(stats *AggregateStats) MetricSummary { return stats.SoilMoisture }},
+	{Key: "temperature", Name: "Temperature", DeviceClass: "temperature", Unit: "°C", Format: "%.1f",
+		Value:   func(data *ParasiteData) float64 { return float64(data.TempCelcius) },
+		Summary: func(stats *AggregateStats) MetricSummary { return stats.TempCelcius }},
+	{Key: "humidity", Name: "Humidity", DeviceClass: "humidity", Unit: "%", Format: "%.1f",
+		Value:   func(data *ParasiteData) float64 { return float64(data.Humidity) },
+		Summary: func(stats *AggregateStats) MetricSummary { return stats.Humidity }},
+	{Key: "battery_voltage", Name: "Battery Voltage", DeviceClass: "voltage", Unit: "V", Format: "%.1f", Diagnostic: true,
+		Value:   func(data *ParasiteData) float64 { return float64(data.BatteryVoltage) },
+		Summary: func(stats *AggregateStats) MetricSummary { return stats.BatteryVoltage }},
+	{Key: "rssi", Name: "RSSI", DeviceClass: "signal_strength", Unit: "dB", Format: "%.0f", Diagnostic: true,
+		Value:   func(data *ParasiteData) float64 { return float64(data.RSSI) },
+		Summary: func(stats *AggregateStats) MetricSummary { return stats.RSSI }},
+}
+
+// The key of the "last seen" entity, which holds the time of the latest
+// reading, and the metric its value is published as.
+const kLastSeenEntity = "last_seen"
+const kTimestampMetric = "timestamp"
+
+// For aggregated readings, the number of samples is published as this metric,
+// and each metric's min and max are published with these suffixes.
+const kSamplesMetric = "samples"
+const kMinSuffix = "_min"
+const kMaxSuffix = "_max"
+
+// makeStatePayload builds the JSON document published in the "json" payload
+// format. Values are formatted the same way as in the "plain" format.
+func makeStatePayload(cfg *MQTTConfig, data *ParasiteData) (string, error) {
+	state := map[string]interface{}{
+		"counter":        data.Counter,
+		kTimestampMetric: data.Time.Format(time.RFC3339),
+	}
+	for _, metric := range availableMetrics(kMQTTMetrics, data) {
+		state[metric.Key] = json.Number(cfg.FormatMetric(metric, metric.Value(data)))
+		if data.Aggregate != nil {
+			summary := metric.Summary(data.Aggregate)
+			state[metric.Key+kMinSuffix] = json.Number(cfg.FormatMetric(metric, summary.Min))
+			state[metric.Key+kMaxSuffix] = json.Number(cfg.FormatMetric(metric, summary.Max))
+		}
+	}
+	if data.Aggregate != nil {
+		state[kSamplesMetric] = data.Aggregate.Samples
+	}
+	payload, err := json.Marshal(state)
+	return string(payload), err
+}
+
+// availableMetrics returns the metrics the reading has a value for.
+func availableMetrics(metrics []*MQTTMetric, data *ParasiteData) []*MQTTMetric {
+	available := []*MQTTMetric{}
+	for _, metric := range metrics {
+		if data.HasMetric(metric.Key) {
+			available = append(available, metric)
+		}
+	}
+	return available
+}
+
+// publishData publishes a reading. If wait is set, it waits for the broker to
+// acknowledge it, which the offline buffer needs to know whether to keep the
+// reading. Messages that are still in flight after kPublishTimeout are left to
+// paho, which will keep retrying them, so only outright failures are reported.
+// Otherwise, acknowledgements are only tracked in the background, so a slow or
+// unreachable broker doesn't hold up the readings of every output.
+// In change-only mode, only metrics that changed enough are published, unless
+// force is set. The timestamp is published either way, so the "last seen"
+// entity keeps up with the device.
+func (client *MQTTClient) publishData(deviceConfig *MQTTParasiteConfig, data *ParasiteData, force bool, wait bool) error {
+	metrics := availableMetrics(kMQTTMetrics, data)
+	if client.config.ChangeOnly && !force {
+		metrics = availableMetrics(client.changes.Filter(client.config, deviceConfig.MAC, data), data)
+		if len(metrics) == 0 {
+			logger.Printf("[mqtt] Only publishing the timestamp of unchanged data from %s\n", data.Key)
+		}
+	}
+
+	tokens := []mqtt.Token{}
+	switch {
+	case len(metrics) == 0:
+		// Nothing but the timestamp to publish.
+	case client.config.PayloadFormat == "json":
+		// The JSON document always holds every metric the reading has, so they
+		// all count as published.
+		metrics = availableMetrics(kMQTTMetrics, data)
+		payload, err := makeStatePayload(client.config, data)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, client.Publish(client.config.StateTopic(deviceConfig), payload, false, 1))
+	default:
+		for _, metric := range metrics {
+			tokens = append(tokens, client.Publish(client.config.MetricTopic(deviceConfig, metric.Key), client.config.FormatMetric(metric, metric.Value(data)), false, 1))
+			if data.Aggregate != nil {
+				summary := metric.Summary(data.Aggregate)
+				tokens = append(tokens,
+					client.Publish(client.config.MetricTopic(deviceConfig, metric.Key+kMinSuffix), client.config.FormatMetric(metric, summary.Min), false, 1),
+					client.Publish(client.config.MetricTopic(deviceConfig, metric.Key+kMaxSuffix), client.config.FormatMetric(metric, summary.Max), false, 1))
+			}
+		}
+		if data.Aggregate != nil {
+			tokens = append(tokens, client.Publish(client.config.MetricTopic(deviceConfig, kSamplesMetric), fmt.Sprintf("%d", data.Aggregate.Samples), false, 1))
+		}
+	}
+	// In the json format, the document holds the timestamp, unless change-only
+	// mode may leave the document out.
+	if client.config.PayloadFormat != "json" || client.config.ChangeOnly {
+		tokens = append(tokens, client.Publish(client.config.MetricTopic(deviceConfig, kTimestampMetric), data.Time.Format(time.RFC3339), false, 1))
+	}
+	if wait {
+		for _, token := range tokens {
+			if !token.WaitTimeout(kPublishTimeout) {
+				logger.Printf("[mqtt] Timed out waiting for %s to acknowledge data from %s\n", client.config.Host, data.Key)
+				break
+			}
+			if token.Error() != nil {
+				return token.Error()
+			}
+		}
+	}
+	client.changes.Record(client.config, deviceConfig.MAC, data, metrics)
+	return nil
+}
+
+// publishDiagnostics periodically publishes a snapshot of the scanner's stats.
+func (client *MQTTClient) publishDiagnostics() {
+	for range time.Tick(client.config.DiagnosticsInterval) {
+		if !client.client.IsConnectionOpen() {
+			continue
+		}
+		payload, err := json.Marshal(stats.Snapshot())
+		if err != nil {
+			logger.Printf("[mqtt] Unable to encode diagnostics: %s\n", err.Error())
+			continue
+		}
+		client.Publish(client.config.DiagnosticsTopic(), string(payload), false, 1)
+	}
+}
+
+// enqueue stores a reading in the offline buffer. If we're connected, the
+// replay goroutine is woken up to flush it.
+func (client *MQTTClient) enqueue(data *ParasiteData) {
+	if err := client.queue.Push(data); err != nil {
+		logger.Printf("[mqtt] Unable to buffer data from %s: %s\n", data.Key, err.Error())
+		return
+	}
+	if client.client.IsConnectionOpen() {
+		client.requestReplay()
+	}
+}
+
+func (client *MQTTClient) requestReplay() {
+	select {
+	case client.replayRequests <- struct{}{}:
+	default:
+	}
+}
+
+// replayQueue publishes buffered readings, oldest first, whenever a replay is
+// requested. Readings are only removed from the buffer once published.
+func (client *MQTTClient) replayQueue() {
+	for range client.replayRequests {
+		for client.client.IsConnectionOpen() {
+			data := client.queue.Peek()
+			if data == nil {
+				break
+			}
+			if deviceConfig, exists := client.registry()[MACAddr(data.Key)]; exists {
+				if err := client.publishData(deviceConfig, data, false, true); err != nil {
+					logger.Printf("[mqtt] Unable to replay buffered data from %s: %s\n", data.Key, err.Error())
+					break
+				}
+			}
+			if err := client.queue.Remove(data); err != nil {
+				logger.Printf("[mqtt] Unable to update offline buffer: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+func (client *MQTTClient) Publish(topic string, msg string, retained bool, qos byte) mqtt.Token {
+	return publishTracked(client.client, topic, msg, retained, qos)
 }
 
 func (client *MQTTClient) Ingest(data *ParasiteData) {
 	client.outgoing <- data
 }
 
-func (client *MQTTClient) Run() {
-	if token := client.client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
+func (client *MQTTClient) connect() {
+	connectWhileLeader(client.client, client.config.Host)
+}
 
+// onConnect is called by paho on the initial connection and after every
+// reconnection. Retained messages may have been lost in the meantime (e.g. if
+// the broker restarted), so we republish the discovery messages and our status.
+func (client *MQTTClient) onConnect(_ mqtt.Client) {
+	logger.Printf("[mqtt] Connected to %s\n", client.config.Host)
+	client.publishDiscovery()
+	client.Publish(client.config.AvailabilityTopic(), "online", true, 1)
+	client.publishAllDeviceAvailability()
+	if client.queue != nil {
+		client.requestReplay()
+	}
 	if client.config.AutoDiscovery {
-		for macAddr, deviceConfig := range client.config.Registry {
-			logger.Printf("Generating auto-discovery messages for %s\n", macAddr)
-			for _, msg := range makeAutoDiscoveryMessages(deviceConfig) {
-				payload, _ := json.Marshal(msg.Payload)
-				client.Publish(msg.Topic, string(payload), true, 1)
+		// Subscriptions don't survive reconnections with a clean session, so we
+		// (re)subscribe here.
+		client.client.Subscribe(client.config.HAStatusTopic(), 1, client.onHAStatus)
+	}
+	if client.config.Commands {
+		client.client.Subscribe(client.config.CommandsTopic()+"/#", 1, client.onCommand)
+	}
+	if elector != nil {
+		client.client.Subscribe(client.config.AvailabilityTopic(), 1, client.onAvailability)
+	}
+}
+
+// With leader election, the previous leader's will may mark us offline after
+// we took over, since the broker only notices it's gone after a while. We're
+// still online, so we say so again.
+func (client *MQTTClient) onAvailability(_ mqtt.Client, msg mqtt.Message) {
+	if string(msg.Payload()) == "offline" && isLeader() {
+		logger.Printf("[mqtt] %s was marked offline, most likely by the previous leader's will\n", msg.Topic())
+		client.Publish(client.config.AvailabilityTopic(), "online", true, 1)
+	}
+}
+
+// Home Assistant publishes "online" to its status topic when it (re)starts. If
+// the broker doesn't retain our messages, that's its only chance of learning
+// about our entities and their states, so we republish them. Every scanner on
+// the broker receives the same message, so we wait for a random delay first to
+// spread out the load.
+func (client *MQTTClient) onHAStatus(_ mqtt.Client, msg mqtt.Message) {
+	if string(msg.Payload()) != "online" {
+		return
+	}
+	delay := time.Duration(rand.Int63n(int64(kMaxHABirthDelay)))
+	logger.Printf("[mqtt] Home Assistant came online, republishing discovery and state in %s\n", delay)
+	go func() {
+		time.Sleep(delay)
+		client.publishDiscovery()
+		client.Publish(client.config.AvailabilityTopic(), "online", true, 1)
+		client.publishAllDeviceAvailability()
+		for macAddr, deviceConfig := range client.registry() {
+			if data := client.devices.Latest(macAddr); data != nil {
+				if err := client.publishData(deviceConfig, data, true, false); err != nil {
+					logger.Printf("[mqtt] Unable to republish data from %s: %s\n", macAddr, err.Error())
+				}
 			}
 		}
+	}()
+}
+
+func (client *MQTTClient) publishDiscovery() {
+	if !client.config.AutoDiscovery {
+		return
+	}
+	client.discoveryMu.Lock()
+	defer client.discoveryMu.Unlock()
+
+	for _, msg := range makeBridgeAutoDiscoveryMessages(client.config) {
+		payload, _ := json.Marshal(msg.Payload)
+		client.Publish(msg.Topic, string(payload), true, 1)
 	}
 
-	client.Publish("parasite-scanner/status", "online", true, 1)
+	oldState, err := LoadDiscoveryState(client.config.StateFile)
+	if err != nil {
+		logger.Printf("[mqtt] Unable to load discovery state from %s: %s\n", client.config.StateFile, err.Error())
+		oldState = &DiscoveryState{Devices: map[MACAddr]*DiscoveredDevice{}}
+	}
+	newState := &DiscoveryState{Devices: map[MACAddr]*DiscoveredDevice{}}
+
+	registry := client.registry()
+
+	// Devices that are no longer in the registry would otherwise linger in Home
+	// Assistant forever, since their discovery messages are retained.
+	for macAddr, oldDevice := range oldState.Devices {
+		if _, exists := registry[macAddr]; !exists {
+			logger.Printf("[mqtt] Removing discovery messages for %s (%q), which is no longer configured\n", macAddr, oldDevice.Name)
+			client.clearDiscoveryTopics(oldDevice.Topics, nil)
+		}
+	}
+
+	for macAddr, deviceConfig := range registry {
+		logger.Printf("Generating auto-discovery messages for %s\n", macAddr)
+		published := map[string]bool{}
+		for _, msg := range makeAutoDiscoveryMessages(client.config, deviceConfig) {
+			payload, _ := json.Marshal(msg.Payload)
+			client.Publish(msg.Topic, string(payload), true, 1)
+			published[msg.Topic] = true
+		}
+
+		staleTopics := legacyDiscoveryTopics(client.config, deviceConfig)
+		if oldDevice, exists := oldState.Devices[macAddr]; exists {
+			if oldDevice.Name != deviceConfig.Name {
+				logger.Printf("[mqtt] %s was renamed from %q to %q\n", macAddr, oldDevice.Name, deviceConfig.Name)
+			}
+			staleTopics = oldDevice.Topics
+		}
+		client.clearDiscoveryTopics(staleTopics, published)
+
+		newState.Devices[macAddr] = &DiscoveredDevice{Name: deviceConfig.Name, Topics: sortedKeys(published)}
+	}
+
+	if err := newState.Save(client.config.StateFile); err != nil {
+		logger.Printf("[mqtt] Unable to save discovery state to %s: %s\n", client.config.StateFile, err.Error())
+	}
+}
+
+// clearDiscoveryTopics publishes empty retained messages to the given topics,
+// which makes Home Assistant remove the corresponding entities. Topics in keep
+// are left alone.
+func (client *MQTTClient) clearDiscoveryTopics(topics []string, keep map[string]bool) {
+	for _, topic := range topics {
+		if !keep[topic] {
+			logger.Printf("[mqtt] Clearing stale discovery topic %s\n", topic)
+			client.Publish(topic, "", true, 1)
+		}
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (client *MQTTClient) Run() {
+	// Connect in the background, so incoming data keeps being consumed while
+	// the broker is unreachable.
+	go client.connect()
+	if client.queue != nil {
+		go client.replayQueue()
+	}
+	if client.config.DeviceAvailabilityTimeout > 0 {
+		go client.expireDevices()
+	}
+	if client.config.DiagnosticsInterval > 0 {
+		go client.publishDiagnostics()
+	}
 
 	for data := range client.outgoing {
-		deviceConfig, exists := client.config.Registry[MACAddr(data.Key)]
+		deviceConfig, exists := client.registry()[MACAddr(data.Key)]
 		if !exists {
 			logger.Printf("Received valid BLE broadcast from %s, but it's not configured for MQTT\n", data.Key)
 			continue
 		}
-		client.publishData(deviceConfig, data)
+		if client.isPaused(deviceConfig.MAC) {
+			continue
+		}
+		cameOnline := client.devices.Seen(deviceConfig.MAC, data)
+		// The standby keeps track of devices, so it can take over where the
+		// leader left off, but leaves publishing to the leader.
+		if !isLeader() {
+			continue
+		}
+		if cameOnline {
+			client.publishDeviceAvailability(deviceConfig.MAC, true)
+		}
+		// Readings must not overtake the ones waiting in the offline buffer.
+		if client.queue != nil && (!client.client.IsConnectionOpen() || client.queue.Len() > 0) {
+			client.enqueue(data)
+			continue
+		}
+		// Without the offline buffer, there's nowhere to keep readings until we
+		// reconnect. paho would hold on to them, but the reading would be stale
+		// by the time it's delivered.
+		if client.queue == nil && !client.client.IsConnectionOpen() {
+			logger.Printf("[mqtt] Not connected to %s, dropping data from %s\n", client.config.Host, data.Key)
+			continue
+		}
+		if err := client.publishData(deviceConfig, data, false, client.queue != nil); err != nil {
+			logger.Printf("[mqtt] Unable to publish data from %s: %s\n", data.Key, err.Error())
+			if client.queue != nil {
+				client.enqueue(data)
+			}
+		}
 	}
 }
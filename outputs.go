@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OutputConfig describes a single entry of the `outputs` config list.
+// Besides `type` and an optional `name`, each entry carries options that are
+// specific to its output type. Those are kept undecoded and handed to the
+// output's factory, which knows what to make of them.
+type OutputConfig struct {
+	Type string
+	Name string
+	// If set, the output is fed aggregated readings instead of raw ones.
+	Aggregate *AggregateConfig
+	options   yaml.Node
+	// The config this output belongs to.
+	root *Config
+}
+
+func (cfg *OutputConfig) UnmarshalYAML(node *yaml.Node) error {
+	header := struct {
+		Type      string           `yaml:"type"`
+		Name      string           `yaml:"name"`
+		Aggregate *AggregateConfig `yaml:"aggregate"`
+	}{}
+	if err := node.Decode(&header); err != nil {
+		return err
+	}
+	cfg.Type = header.Type
+	cfg.Name = header.Name
+	cfg.Aggregate = header.Aggregate
+	cfg.options = *node
+	return nil
+}
+
+// DecodeOptions decodes the output-specific options into v.
+// The `type`, `name` and `aggregate` keys are part of the same mapping, so v
+// should simply not declare them.
+func (cfg *OutputConfig) DecodeOptions(v interface{}) error {
+	if cfg.options.Kind == 0 {
+		return nil
+	}
+	return cfg.options.Decode(v)
+}
+
+// An OutputFactory builds a DataSubscriber from its config entry.
+type OutputFactory func(cfg *OutputConfig) (DataSubscriber, error)
+
+var outputFactories = map[string]OutputFactory{}
+
+// RegisterOutput makes an output type available to the `outputs` config list.
+// It's meant to be called from the init() function of the file implementing
+// the output, so adding a new type doesn't require touching main.go.
+func RegisterOutput(outputType string, factory OutputFactory) {
+	if _, exists := outputFactories[outputType]; exists {
+		panic("output type registered twice: " + outputType)
+	}
+	outputFactories[outputType] = factory
+}
+
+func registeredOutputTypes() string {
+	types := make([]string, 0, len(outputFactories))
+	for t := range outputFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// SharedRegistry returns the entries of the top-level registry that are routed
+// to this output.
+func (cfg *OutputConfig) SharedRegistry() map[MACAddr]*MQTTParasiteConfig {
+	if cfg.root == nil {
+		return map[MACAddr]*MQTTParasiteConfig{}
+	}
+	return cfg.root.RegistryFor(cfg.Name)
+}
+
+func ValidateOutputConfigs(root *Config, cfgs []*OutputConfig) error {
+	names := map[string]bool{}
+	if root.MQTT.Host != "" {
+		names[kLegacyMQTTName] = true
+	}
+	for i, cfg := range cfgs {
+		cfg.root = root
+		if cfg.Type == "" {
+			return fmt.Errorf("output #%d: missing type", i)
+		}
+		if _, exists := outputFactories[cfg.Type]; !exists {
+			return fmt.Errorf("output #%d: unknown type %q (available: %s)", i, cfg.Type, registeredOutputTypes())
+		}
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("%s%d", cfg.Type, i)
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("output #%d: duplicate name %q", i, cfg.Name)
+		}
+		names[cfg.Name] = true
+		if cfg.Aggregate != nil && cfg.Aggregate.Window <= 0 {
+			return fmt.Errorf("output %s: aggregate: window must be positive", cfg.Name)
+		}
+	}
+	return nil
+}
+
+// MakeOutputs instantiates a DataSubscriber for every configured output.
+func MakeOutputs(cfgs []*OutputConfig) ([]DataSubscriber, error) {
+	subscribers := []DataSubscriber{}
+	for _, cfg := range cfgs {
+		subs, err := outputFactories[cfg.Type](cfg)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %s", cfg.Name, err.Error())
+		}
+		logger.Printf("[outputs] Initialized %s output %s\n", cfg.Type, cfg.Name)
+		if cfg.Aggregate != nil {
+			subs = MakeAggregator(subs, cfg.Aggregate.Window)
+		}
+		subscribers = append(subscribers, subs)
+	}
+	return subscribers, nil
+}
+
+// ReloadOutputConfig re-reads the config file and returns the config of the
+// output with the given name.
+func ReloadOutputConfig(name string) (*OutputConfig, error) {
+	config, err := ParseConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range config.Outputs {
+		if cfg.Name == name {
+			return cfg, nil
+		}
+	}
+	return nil, fmt.Errorf("output %s is no longer configured", name)
+}
+
+// HasOutput reports whether an output of the given type is configured.
+func (cfg *Config) HasOutput(outputType string) bool {
+	for _, output := range cfg.Outputs {
+		if output.Type == outputType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskQueue is a FIFO of ParasiteData that survives restarts.
+// Items are kept in memory and mirrored to a file with one JSON-encoded item
+// per line. Pushing appends a line to the file. Removing items only records
+// how many lines at the start of the file have been consumed, in a small
+// ".offset" file next to it; the file is compacted once the consumed lines
+// outnumber the remaining ones, or when the queue is emptied. Once the queue
+// holds more than maxSize items, the oldest ones are dropped. Items older than
+// maxAge are dropped as well.
+type DiskQueue struct {
+	mu       sync.Mutex
+	filename string
+	maxSize  int
+	maxAge   time.Duration
+	items    []*ParasiteData
+	// The number of lines at the start of the file that were already removed.
+	consumed int
+}
+
+// Compacting a file with fewer consumed lines than this isn't worth it.
+const kQueueMinCompaction = 100
+
+func MakeDiskQueue(filename string, maxSize int, maxAge time.Duration) (*DiskQueue, error) {
+	queue := &DiskQueue{
+		filename: filename,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		items:    []*ParasiteData{},
+	}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return queue, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// A missing or unreadable offset replays the whole file: readings may be
+	// published twice, but none are lost.
+	skip := 0
+	if offset, err := os.ReadFile(queue.offsetFilename()); err == nil {
+		skip, _ = strconv.Atoi(strings.TrimSpace(string(offset)))
+	}
+
+	scanner := bufio.NewScanner(file)
+	for line := 0; scanner.Scan(); line++ {
+		if line < skip {
+			continue
+		}
+		data := &ParasiteData{}
+		if err := json.Unmarshal(scanner.Bytes(), data); err != nil {
+			logger.Printf("[queue] Skipping corrupt entry in %s: %s\n", filename, err.Error())
+			continue
+		}
+		queue.items = append(queue.items, data)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.trim()
+	return queue, queue.persist()
+}
+
+func (queue *DiskQueue) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.items)
+}
+
+func (queue *DiskQueue) Push(data *ParasiteData) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.items = append(queue.items, data)
+	if dropped := queue.trim(); dropped > 0 {
+		if err := queue.consume(dropped); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(queue.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	line, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Peek returns the oldest item in the queue, or nil if it's empty.
+func (queue *DiskQueue) Peek() *ParasiteData {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if dropped := queue.trim(); dropped > 0 {
+		if err := queue.consume(dropped); err != nil {
+			logger.Printf("[queue] Unable to update %s: %s\n", queue.filename, err.Error())
+		}
+	}
+	if len(queue.items) == 0 {
+		return nil
+	}
+	return queue.items[0]
+}
+
+// Remove drops the oldest item in the queue if it's data. This allows the
+// caller to only remove an item after it's been successfully processed.
+func (queue *DiskQueue) Remove(data *ParasiteData) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if len(queue.items) == 0 || queue.items[0] != data {
+		return nil
+	}
+	queue.items = queue.items[1:]
+	return queue.consume(1)
+}
+
+// consume records that n more lines at the start of the file were removed,
+// compacting the file if it's worth it. It must be called with the lock held.
+func (queue *DiskQueue) consume(n int) error {
+	queue.consumed += n
+	if len(queue.items) == 0 || (queue.consumed >= kQueueMinCompaction && queue.consumed >= len(queue.items)) {
+		return queue.persist()
+	}
+	return queue.writeOffset()
+}
+
+// trim drops items exceeding the size and age limits and returns how many were
+// dropped. It must be called with the lock held.
+func (queue *DiskQueue) trim() int {
+	dropped := 0
+	if queue.maxSize > 0 && len(queue.items) > queue.maxSize {
+		dropped = len(queue.items) - queue.maxSize
+	}
+	if queue.maxAge > 0 {
+		for dropped < len(queue.items) && time.Since(queue.items[dropped].Time) > queue.maxAge {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return 0
+	}
+	logger.Printf("[queue] Dropping %d entries from %s due to size or age limits\n", dropped, queue.filename)
+	queue.items = queue.items[dropped:]
+	return dropped
+}
+
+func (queue *DiskQueue) offsetFilename() string {
+	return queue.filename + ".offset"
+}
+
+func (queue *DiskQueue) writeOffset() error {
+	return os.WriteFile(queue.offsetFilename(), []byte(strconv.Itoa(queue.consumed)+"\n"), 0644)
+}
+
+// persist rewrites the backing file with the current items, and resets the
+// offset. It must be called with the lock held.
+func (queue *DiskQueue) persist() error {
+	tmpFilename := queue.filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, data := range queue.items {
+		if err := encoder.Encode(data); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// Resetting the offset first means a crash in between replays consumed
+	// readings rather than skipping pending ones.
+	queue.consumed = 0
+	if err := queue.writeOffset(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, queue.filename)
+}
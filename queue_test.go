@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueSurvivesRestarts(t *testing.T) {
+	discardLogs()
+	filename := filepath.Join(t.TempDir(), "test.queue")
+	queue, err := MakeDiskQueue(filename, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 250; i++ {
+		if err := queue.Push(&ParasiteData{Key: fmt.Sprint(i), Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Few enough removals that only the offset is updated, then enough that
+	// the file is compacted.
+	for _, removals := range []int{60, 100} {
+		for i := 0; i < removals; i++ {
+			if err := queue.Remove(queue.Peek()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := queue.Len()
+		head := queue.Peek().Key
+		if queue, err = MakeDiskQueue(filename, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if queue.Len() != want || queue.Peek().Key != head {
+			t.Errorf("after restarting, got %d items starting with %s, want %d starting with %s", queue.Len(), queue.Peek().Key, want, head)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTLinkConfig configures a broker over which the scanner exchanges messages
+// other than the readings it publishes, e.g. with satellites.
+type MQTTLinkConfig struct {
+	Host     string     `yaml:"host"`
+	Username string     `yaml:"username"`
+	Password string     `yaml:"password"`
+	ClientId string     `yaml:"client_id"`
+	TLS      *TLSConfig `yaml:"tls"`
+	Topic    string     `yaml:"topic"`
+}
+
+func ValidateMQTTLinkConfig(cfg *MQTTLinkConfig, defaultTopic string) error {
+	if cfg.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if err := ValidateTLSConfig(cfg.TLS); err != nil {
+		return fmt.Errorf("tls: %s", err.Error())
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = defaultTopic
+	}
+	return nil
+}
+
+// HTTPEndpointConfig configures an HTTP endpoint that receives messages in
+// POST requests. If Token is set, requests must carry it as a bearer token. It
+// may only be left out on loopback addresses.
+type HTTPEndpointConfig struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+	Token  string `yaml:"token"`
+}
+
+func ValidateHTTPEndpointConfig(cfg *HTTPEndpointConfig, defaultPath string) error {
+	if cfg.Listen == "" {
+		return fmt.Errorf("missing listen")
+	}
+	if cfg.Token == "" && !isLoopbackAddr(cfg.Listen) {
+		return fmt.Errorf("token must be set to listen on %s, which isn't a loopback address", cfg.Listen)
+	}
+	if cfg.Path == "" {
+		cfg.Path = defaultPath
+	}
+	return nil
+}
+
+// The largest request body accepted by HTTP endpoints.
+const kMaxHTTPBodySize = 1 << 20
+
+// makeMQTTReceiver returns a client that calls handle for every message
+// published to any of filters. Like outputs, it needs to be connected with
+// connectWithRetry.
+func makeMQTTReceiver(cfg *MQTTLinkConfig, handle mqtt.MessageHandler, filters ...string) (mqtt.Client, error) {
+	opts, err := makeLinkClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		logger.Printf("[mqtt] Connected to %s, subscribing to %s\n", cfg.Host, strings.Join(filters, ", "))
+		// Subscriptions don't survive reconnections with a clean session, so we
+		// (re)subscribe here.
+		for _, filter := range filters {
+			client.Subscribe(filter, 1, handle)
+		}
+	})
+	return mqtt.NewClient(opts), nil
+}
+
+// serveHTTP calls handle with the body of every request POSTed to the
+// endpoint. Errors returned by handle are reported back to the client.
+func serveHTTP(cfg *HTTPEndpointConfig, handle func(body []byte) error) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+cfg.Token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, kMaxHTTPBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := handle(body); err != nil {
+			logger.Printf("[http] Rejecting request from %s to %s: %s\n", r.RemoteAddr, cfg.Path, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	logger.Printf("[http] Listening on %s%s\n", cfg.Listen, cfg.Path)
+	return http.ListenAndServe(cfg.Listen, mux)
+}
+
+// MessageReceiver is a source of readings received as messages over MQTT, HTTP
+// or both. Messages are turned into readings by decode.
+type MessageReceiver struct {
+	tag    string
+	mqtt   *MQTTLinkConfig
+	http   *HTTPEndpointConfig
+	decode func(payload []byte) ([]*ParasiteData, error)
+	client mqtt.Client
+	sink   chan<- *ParasiteData
+}
+
+// MakeMessageReceiver makes a receiver subscribing to filter on the mqtt
+// broker, if set, and serving the http endpoint, if set. tag prefixes its logs.
+func MakeMessageReceiver(tag string, mqttCfg *MQTTLinkConfig, filter string, httpCfg *HTTPEndpointConfig, decode func(payload []byte) ([]*ParasiteData, error)) (*MessageReceiver, error) {
+	receiver := &MessageReceiver{
+		tag:    tag,
+		mqtt:   mqttCfg,
+		http:   httpCfg,
+		decode: decode,
+	}
+	if mqttCfg != nil {
+		client, err := makeMQTTReceiver(mqttCfg, receiver.onMessage, filter)
+		if err != nil {
+			return nil, err
+		}
+		receiver.client = client
+	}
+	return receiver, nil
+}
+
+func (receiver *MessageReceiver) onMessage(_ mqtt.Client, msg mqtt.Message) {
+	readings, err := receiver.decode(msg.Payload())
+	if err != nil {
+		logger.Printf("[%s] Ignoring message on %s: %s\n", receiver.tag, msg.Topic(), err.Error())
+		return
+	}
+	for _, data := range readings {
+		receiver.sink <- data
+	}
+}
+
+func (receiver *MessageReceiver) Run(sink chan<- *ParasiteData) {
+	receiver.sink = sink
+	if receiver.client != nil {
+		go connectWithRetry(receiver.client, receiver.mqtt.Host)
+	}
+	if receiver.http == nil {
+		select {}
+	}
+	err := serveHTTP(receiver.http, func(body []byte) error {
+		readings, err := receiver.decode(body)
+		if err != nil {
+			return err
+		}
+		for _, data := range readings {
+			sink <- data
+		}
+		return nil
+	})
+	panic("unable to serve " + receiver.tag + " endpoint: " + err.Error())
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// SatelliteMessage is what satellites forward to the central instance: either
+// a decoded reading, or the advertisement it was decoded from, in which case
+// the central instance decodes it itself.
+type SatelliteMessage struct {
+	Satellite     string            `json:"satellite"`
+	Reading       *ParasiteData     `json:"reading,omitempty"`
+	Advertisement *RawAdvertisement `json:"advertisement,omitempty"`
+}
+
+// Satellites publish to <topic>/<id>, and the central instance subscribes to
+// <topic>/+.
+const kDefaultSatelliteTopic = "parasite-scanner/satellites"
+const kDefaultSatellitePath = "/satellite"
+
+// How long the central instance waits for other satellites' copies of an
+// advertisement by default, so the best-RSSI one is kept.
+const kDefaultSatelliteDedupWindow = 2 * time.Second
+
+// HTTPTargetConfig configures where messages are POSTed to. If Token is set,
+// it's sent as a bearer token.
+type HTTPTargetConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+// SatelliteConfig configures a satellite's forwarding of readings to the
+// central instance, over either MQTT or HTTP.
+type SatelliteConfig struct {
+	ID string `yaml:"id"`
+	// Either "readings" or "advertisements".
+	Forward string            `yaml:"forward"`
+	MQTT    *MQTTLinkConfig   `yaml:"mqtt"`
+	HTTP    *HTTPTargetConfig `yaml:"http"`
+}
+
+func ValidateSatelliteConfig(cfg *SatelliteConfig) error {
+	if cfg.ID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("missing id")
+		}
+		cfg.ID = hostname
+	}
+	if strings.ContainsAny(cfg.ID, "/+#") {
+		return fmt.Errorf("invalid id %q", cfg.ID)
+	}
+	switch cfg.Forward {
+	case "":
+		cfg.Forward = "readings"
+	case "readings", "advertisements":
+	default:
+		return fmt.Errorf("invalid forward: %s", cfg.Forward)
+	}
+	if (cfg.MQTT == nil) == (cfg.HTTP == nil) {
+		return fmt.Errorf("exactly one of mqtt and http must be set")
+	}
+	if cfg.MQTT != nil {
+		if err := ValidateMQTTLinkConfig(cfg.MQTT, kDefaultSatelliteTopic); err != nil {
+			return fmt.Errorf("mqtt: %s", err.Error())
+		}
+	}
+	if cfg.HTTP != nil && cfg.HTTP.URL == "" {
+		return fmt.Errorf("http: missing url")
+	}
+	return nil
+}
+
+// SatelliteForwarder is the output of satellites, forwarding what they receive
+// to the central instance.
+type SatelliteForwarder struct {
+	config   *SatelliteConfig
+	outgoing chan *ParasiteData
+	client   mqtt.Client
+	http     *http.Client
+}
+
+func init() {
+	RegisterOutput("satellite", func(cfg *OutputConfig) (DataSubscriber, error) {
+		satelliteCfg := &SatelliteConfig{}
+		if err := cfg.DecodeOptions(satelliteCfg); err != nil {
+			return nil, err
+		}
+		if err := ValidateSatelliteConfig(satelliteCfg); err != nil {
+			return nil, err
+		}
+		return MakeSatelliteForwarder(satelliteCfg)
+	})
+	RegisterSource("satellites", func(cfg *SourceConfig) (DataSource, error) {
+		receiverCfg := &SatelliteReceiverConfig{}
+		if err := cfg.DecodeOptions(receiverCfg); err != nil {
+			return nil, err
+		}
+		if err := ValidateSatelliteReceiverConfig(receiverCfg); err != nil {
+			return nil, err
+		}
+		return makeSatelliteReceiver(receiverCfg, &cfg.root.BLE)
+	})
+}
+
+func MakeSatelliteForwarder(cfg *SatelliteConfig) (*SatelliteForwarder, error) {
+	forwarder := &SatelliteForwarder{
+		config:   cfg,
+		outgoing: make(chan *ParasiteData),
+		http:     &http.Client{Timeout: kPublishTimeout},
+	}
+	if cfg.MQTT != nil {
+		opts, err := makeLinkClientOptions(cfg.MQTT)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetOnConnectHandler(func(_ mqtt.Client) {
+			logger.Printf("[satellite] Connected to %s\n", cfg.MQTT.Host)
+		})
+		forwarder.client = mqtt.NewClient(opts)
+	}
+	return forwarder, nil
+}
+
+func (forwarder *SatelliteForwarder) Ingest(data *ParasiteData) {
+	forwarder.outgoing <- data
+}
+
+// post sends a message to the central instance over HTTP, recording the
+// outcome in the stats like MQTT publishes.
+func (forwarder *SatelliteForwarder) post(payload []byte) {
+	cfg := forwarder.config.HTTP
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if cfg.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.Token)
+		}
+		resp, err := forwarder.http.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		logger.Printf("[satellite] Forwarding to %s failed: %s\n", cfg.URL, err.Error())
+	}
+	stats.RecordPublish(cfg.URL, time.Since(start), err)
+}
+
+func (forwarder *SatelliteForwarder) Run() {
+	if forwarder.client != nil {
+		go connectWithRetry(forwarder.client, forwarder.config.MQTT.Host)
+	}
+
+	for data := range forwarder.outgoing {
+		msg := &SatelliteMessage{Satellite: forwarder.config.ID}
+		// Readings that weren't decoded from an advertisement at hand (e.g.
+		// aggregated ones) are forwarded as they are.
+		if forwarder.config.Forward == "advertisements" && data.Advertisement != nil {
+			msg.Advertisement = data.Advertisement
+		} else {
+			msg.Reading = data
+		}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			logger.Printf("[satellite] Unable to encode reading from %s: %s\n", data.Key, err.Error())
+			continue
+		}
+		if forwarder.client != nil {
+			publishTracked(forwarder.client, forwarder.config.MQTT.Topic+"/"+forwarder.config.ID, string(payload), false, 1)
+		} else {
+			forwarder.post(payload)
+		}
+	}
+}
+
+// SatelliteReceiverConfig configures how the central instance receives
+// satellites' messages: over MQTT, HTTP or both.
+type SatelliteReceiverConfig struct {
+	MQTT *MQTTLinkConfig     `yaml:"mqtt"`
+	HTTP *HTTPEndpointConfig `yaml:"http"`
+}
+
+func ValidateSatelliteReceiverConfig(cfg *SatelliteReceiverConfig) error {
+	if cfg.MQTT == nil && cfg.HTTP == nil {
+		return fmt.Errorf("at least one of mqtt and http must be set")
+	}
+	if cfg.MQTT != nil {
+		if err := ValidateMQTTLinkConfig(cfg.MQTT, kDefaultSatelliteTopic); err != nil {
+			return fmt.Errorf("mqtt: %s", err.Error())
+		}
+	}
+	if cfg.HTTP != nil {
+		if err := ValidateHTTPEndpointConfig(cfg.HTTP, kDefaultSatellitePath); err != nil {
+			return fmt.Errorf("http: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// makeSatelliteReceiver makes the source of readings forwarded by satellites.
+func makeSatelliteReceiver(cfg *SatelliteReceiverConfig, ble *BLEConfig) (*MessageReceiver, error) {
+	var filter string
+	if cfg.MQTT != nil {
+		filter = cfg.MQTT.Topic + "/+"
+	}
+	return MakeMessageReceiver("satellite", cfg.MQTT, filter, cfg.HTTP, func(payload []byte) ([]*ParasiteData, error) {
+		data, err := decodeSatelliteMessage(payload, ble)
+		if err != nil {
+			return nil, err
+		}
+		return []*ParasiteData{data}, nil
+	})
+}
+
+// decodeSatelliteMessage turns a satellite's message into a reading, tagged
+// with the satellite's ID.
+func decodeSatelliteMessage(payload []byte, ble *BLEConfig) (*ParasiteData, error) {
+	msg := &SatelliteMessage{}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+	if msg.Satellite == "" {
+		return nil, fmt.Errorf("missing satellite")
+	}
+	var data *ParasiteData
+	switch {
+	case msg.Advertisement != nil:
+		decoded, err := msg.Advertisement.Decode(ble)
+		if err != nil {
+			stats.RecordDecodeError()
+			return nil, err
+		}
+		data = decoded
+	case msg.Reading != nil && msg.Reading.Key != "":
+		data = msg.Reading
+		data.Key = strings.ToLower(data.Key)
+	default:
+		return nil, fmt.Errorf("missing reading or advertisement")
+	}
+	data.Satellite = msg.Satellite
+	return data, nil
+}
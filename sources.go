@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceConfig describes a single entry of the `sources` config list. Like
+// OutputConfig, it carries options specific to the source's type, which are
+// handed to the source's factory undecoded.
+type SourceConfig struct {
+	Type    string
+	Name    string
+	options yaml.Node
+	// The config this source belongs to.
+	root *Config
+}
+
+func (cfg *SourceConfig) UnmarshalYAML(node *yaml.Node) error {
+	header := struct {
+		Type string `yaml:"type"`
+		Name string `yaml:"name"`
+	}{}
+	if err := node.Decode(&header); err != nil {
+		return err
+	}
+	cfg.Type = header.Type
+	cfg.Name = header.Name
+	cfg.options = *node
+	return nil
+}
+
+// DecodeOptions decodes the source-specific options into v.
+func (cfg *SourceConfig) DecodeOptions(v interface{}) error {
+	if cfg.options.Kind == 0 {
+		return nil
+	}
+	return cfg.options.Decode(v)
+}
+
+// A SourceFactory builds a DataSource from its config entry.
+type SourceFactory func(cfg *SourceConfig) (DataSource, error)
+
+var sourceFactories = map[string]SourceFactory{}
+
+// RegisterSource makes a source type available to the `sources` config list.
+// Like RegisterOutput, it's meant to be called from an init() function.
+func RegisterSource(sourceType string, factory SourceFactory) {
+	if _, exists := sourceFactories[sourceType]; exists {
+		panic("source type registered twice: " + sourceType)
+	}
+	sourceFactories[sourceType] = factory
+}
+
+func registeredSourceTypes() string {
+	types := make([]string, 0, len(sourceFactories))
+	for t := range sourceFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// ValidateSourceConfigs checks the `sources` list. Without one, readings come
+// from the local BLE adapter only.
+func ValidateSourceConfigs(root *Config) error {
+	if len(root.Sources) == 0 {
+		root.Sources = []*SourceConfig{{Type: "ble"}}
+	}
+	names := map[string]bool{}
+	for i, cfg := range root.Sources {
+		cfg.root = root
+		if cfg.Type == "" {
+			return fmt.Errorf("source #%d: missing type", i)
+		}
+		if _, exists := sourceFactories[cfg.Type]; !exists {
+			return fmt.Errorf("source #%d: unknown type %q (available: %s)", i, cfg.Type, registeredSourceTypes())
+		}
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("%s%d", cfg.Type, i)
+		}
+		if names[cfg.Name] {
+			return fmt.Errorf("source #%d: duplicate name %q", i, cfg.Name)
+		}
+		names[cfg.Name] = true
+	}
+	return nil
+}
+
+// MakeSources instantiates a DataSource for every configured source.
+func MakeSources(cfgs []*SourceConfig) ([]DataSource, error) {
+	sources := []DataSource{}
+	for _, cfg := range cfgs {
+		source, err := sourceFactories[cfg.Type](cfg)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %s", cfg.Name, err.Error())
+		}
+		logger.Printf("[sources] Initialized %s source %s\n", cfg.Type, cfg.Name)
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// HasSource reports whether a source of the given type is configured.
+func (cfg *Config) HasSource(sourceType string) bool {
+	for _, source := range cfg.Sources {
+		if source.Type == sourceType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// Stats holds process-wide counters describing how the scanner is doing.
+// Anything may record into it, and outputs may publish snapshots of it.
+type Stats struct {
+	mu              sync.Mutex
+	startTime       time.Time
+	adapterState    string
+	advertisements  *RateCounter
+	parasiteAdverts *RateCounter
+	decodeErrors    uint64
+	devices         map[string]bool
+	publishFailures uint64
+	publishes       map[string]*PublishStats
+	queues          map[string]func() int
+	receptions      map[string]map[string]*ReceptionStats
+}
+
+// ReceptionStats describes how well a receiver (the local adapter or a
+// satellite) hears a device.
+type ReceptionStats struct {
+	// An exponentially weighted moving average.
+	AvgRSSI  float64   `json:"avg_rssi"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// DeviceReception describes how well each receiver hears a device, and which
+// one hears it best.
+type DeviceReception struct {
+	Best      string                     `json:"best"`
+	Receivers map[string]*ReceptionStats `json:"receivers"`
+}
+
+// The weight of a new RSSI sample in ReceptionStats.AvgRSSI.
+const kRSSISmoothing = 0.2
+
+// PublishStats describes the outcome of publishes to a single topic.
+// Latencies are measured from publishing to the broker's acknowledgement.
+type PublishStats struct {
+	Successes      uint64  `json:"successes"`
+	Failures       uint64  `json:"failures"`
+	AvgLatencyMS   float64 `json:"avg_latency_ms"`
+	MaxLatencyMS   float64 `json:"max_latency_ms"`
+	totalLatencyMS float64
+}
+
+var stats = MakeStats()
+
+func MakeStats() *Stats {
+	return &Stats{
+		startTime:       time.Now(),
+		adapterState:    "initializing",
+		advertisements:  &RateCounter{},
+		parasiteAdverts: &RateCounter{},
+		devices:         map[string]bool{},
+		publishes:       map[string]*PublishStats{},
+		queues:          map[string]func() int{},
+		receptions:      map[string]map[string]*ReceptionStats{},
+	}
+}
+
+func (s *Stats) SetAdapterState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adapterState = state
+}
+
+// RecordAdvertisement counts a BLE advertisement, and whether it looked like
+// it came from a b-parasite.
+func (s *Stats) RecordAdvertisement(isParasite bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.advertisements.Add(now)
+	if isParasite {
+		s.parasiteAdverts.Add(now)
+	}
+}
+
+func (s *Stats) RecordDecodeError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decodeErrors++
+}
+
+func (s *Stats) RecordDevice(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[key] = true
+}
+
+// RecordReception records that receiver heard the device with the given key
+// with rssi.
+func (s *Stats) RecordReception(key string, receiver string, rssi int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	receivers, exists := s.receptions[key]
+	if !exists {
+		receivers = map[string]*ReceptionStats{}
+		s.receptions[key] = receivers
+	}
+	reception, exists := receivers[receiver]
+	if !exists {
+		reception = &ReceptionStats{AvgRSSI: float64(rssi)}
+		receivers[receiver] = reception
+	}
+	reception.AvgRSSI += kRSSISmoothing * (float64(rssi) - reception.AvgRSSI)
+	reception.LastSeen = time.Now()
+}
+
+// RecordPublish records the outcome of a publish to topic. A nil err means
+// the broker acknowledged it after latency.
+func (s *Stats) RecordPublish(topic string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topicStats, exists := s.publishes[topic]
+	if !exists {
+		topicStats = &PublishStats{}
+		s.publishes[topic] = topicStats
+	}
+	if err != nil {
+		s.publishFailures++
+		topicStats.Failures++
+		return
+	}
+	latencyMS := float64(latency) / float64(time.Millisecond)
+	topicStats.Successes++
+	topicStats.totalLatencyMS += latencyMS
+	topicStats.AvgLatencyMS = topicStats.totalLatencyMS / float64(topicStats.Successes)
+	if latencyMS > topicStats.MaxLatencyMS {
+		topicStats.MaxLatencyMS = latencyMS
+	}
+}
+
+// RegisterQueue makes the depth of a queue, as reported by depth, part of the
+// snapshots.
+func (s *Stats) RegisterQueue(name string, depth func() int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[name] = depth
+}
+
+type StatsSnapshot struct {
+	Version                         string                      `json:"version"`
+	Uptime                          int64                       `json:"uptime"`
+	AdapterState                    string                      `json:"adapter_state"`
+	AdvertisementsPerMinute         uint64                      `json:"advertisements_per_minute"`
+	ParasiteAdvertisementsPerMinute uint64                      `json:"parasite_advertisements_per_minute"`
+	DecodeErrors                    uint64                      `json:"decode_errors"`
+	UniqueDevices                   int                         `json:"unique_devices"`
+	PublishFailures                 uint64                      `json:"publish_failures"`
+	Publishes                       map[string]*PublishStats    `json:"publishes"`
+	QueueDepths                     map[string]int              `json:"queue_depths"`
+	Receptions                      map[string]*DeviceReception `json:"receptions"`
+}
+
+func (s *Stats) Snapshot() *StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	snapshot := &StatsSnapshot{
+		Version:                         version,
+		Uptime:                          int64(now.Sub(s.startTime).Seconds()),
+		AdapterState:                    s.adapterState,
+		AdvertisementsPerMinute:         s.advertisements.LastMinute(now),
+		ParasiteAdvertisementsPerMinute: s.parasiteAdverts.LastMinute(now),
+		DecodeErrors:                    s.decodeErrors,
+		UniqueDevices:                   len(s.devices),
+		PublishFailures:                 s.publishFailures,
+		Publishes:                       map[string]*PublishStats{},
+		QueueDepths:                     map[string]int{},
+		Receptions:                      map[string]*DeviceReception{},
+	}
+	for topic, topicStats := range s.publishes {
+		copied := *topicStats
+		snapshot.Publishes[topic] = &copied
+	}
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snapshot.QueueDepths[name] = s.queues[name]()
+	}
+	for key, receivers := range s.receptions {
+		device := &DeviceReception{Receivers: map[string]*ReceptionStats{}}
+		for receiver, reception := range receivers {
+			copied := *reception
+			device.Receivers[receiver] = &copied
+			if device.Best == "" || reception.AvgRSSI > device.Receivers[device.Best].AvgRSSI {
+				device.Best = receiver
+			}
+		}
+		snapshot.Receptions[key] = device
+	}
+	return snapshot
+}
+
+// RateCounter counts events over the last minute, in one second buckets.
+type RateCounter struct {
+	counts  [60]uint64
+	seconds [60]int64
+}
+
+func (counter *RateCounter) Add(now time.Time) {
+	second := now.Unix()
+	bucket := second % 60
+	if counter.seconds[bucket] != second {
+		counter.seconds[bucket] = second
+		counter.counts[bucket] = 0
+	}
+	counter.counts[bucket]++
+}
+
+func (counter *RateCounter) LastMinute(now time.Time) uint64 {
+	total := uint64(0)
+	for i := range counter.counts {
+		if now.Unix()-counter.seconds[i] < 60 {
+			total += counter.counts[i]
+		}
+	}
+	return total
+}
@@ -37,6 +37,12 @@ type TUI struct {
 	widgets          *Widgets
 }
 
+func init() {
+	RegisterOutput("tui", func(cfg *OutputConfig) (DataSubscriber, error) {
+		return InitUI(), nil
+	})
+}
+
 func InitUI() *TUI {
 	if err := ui.Init(); err != nil {
 		panic("Failed to initialize termui: " + err.Error())